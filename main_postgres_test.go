@@ -0,0 +1,34 @@
+//go:build postgres
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+)
+
+// TestPostgresRepositoryReads runs against the PostgreSQL database at
+// TEST_DATABASE_URL, emptying it first. Run it with -tags postgres.
+func TestPostgresRepositoryReads(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Fatal("TEST_DATABASE_URL is not set")
+	}
+	db, err := NewPostgresDatabase(fxtest.NewLifecycle(t), zap.NewNop(), &Config{DatabaseURL: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("TRUNCATE books, accounts RESTART IDENTITY CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	testRepositoryReads(t, NewPostgresRepository(db), func(title, author string) {
+		if _, err := db.Exec(postgresDialect.Rebind("INSERT INTO books (title, author, created_at, updated_at) VALUES (?, ?, ?, ?)"), title, author, time.Now().UTC(), time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
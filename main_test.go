@@ -0,0 +1,3199 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestDB opens the app's database in a fresh temporary directory
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	cfg := newTestConfig(t)
+	cfg.DBPath = filepath.Join(t.TempDir(), "app.db")
+	db, err := NewDatabase(fxtest.NewLifecycle(t), zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestRepository returns a SQLite repository over a fresh database
+func newTestRepository(t *testing.T) Repository {
+	t.Helper()
+	return NewSQLiteRepository(newTestDB(t), false)
+}
+
+// newTestConfig returns the default config with the settings that need
+// files on disk pointed at temporary directories or turned off
+func newTestConfig(t *testing.T) *Config {
+	t.Helper()
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	cfg.FingerprintAssets = false
+	cfg.UploadsDir = t.TempDir()
+	cfg.SPAPrefix = ""
+	return cfg
+}
+
+// testServer is the app wired up as main does, over a test repository
+type testServer struct {
+	app  *fiber.App
+	h    *Handler
+	repo Repository
+	cfg  *Config
+}
+
+// newTestServer builds the app around repo. configure, if given, adjusts
+// the config before anything is built from it.
+func newTestServer(t *testing.T, repo Repository, configure ...func(*Config)) *testServer {
+	t.Helper()
+	cfg := newTestConfig(t)
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	app, err := NewFiber(cfg)
+	if err != nil {
+		t.Fatalf("fiber: %v", err)
+	}
+	logger := zap.NewNop()
+	h := NewHandler(repo, logger, cfg, NewViewCounter(fxtest.NewLifecycle(t), repo, logger, cfg))
+	h.RegisterRoutes(app)
+	return &testServer{app: app, h: h, repo: repo, cfg: cfg}
+}
+
+// do sends req to the app and returns the response
+func (s *testServer) do(t *testing.T, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// get requests path, signed in as account unless it is nil
+func (s *testServer) get(t *testing.T, path string, account *Account) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	s.signIn(req, account)
+	return s.do(t, req)
+}
+
+// postForm posts form to path, signed in as account unless it is nil
+func (s *testServer) postForm(t *testing.T, path string, form url.Values, account *Account) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	s.signIn(req, account)
+	return s.do(t, req)
+}
+
+// postJSON posts body as JSON to path, signed in as account unless it is nil
+func (s *testServer) postJSON(t *testing.T, path string, body any, account *Account) *http.Response {
+	t.Helper()
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("encode body: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(encoded)))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	s.signIn(req, account)
+	return s.do(t, req)
+}
+
+// signIn adds a session cookie for account to req
+func (s *testServer) signIn(req *http.Request, account *Account) {
+	if account == nil {
+		return
+	}
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: s.h.signSession(account.ID, time.Now().Add(time.Hour))})
+}
+
+// readBody returns the response body as a string
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return string(body)
+}
+
+// decodeJSON decodes the response body into v
+func decodeJSON(t *testing.T, resp *http.Response, v any) {
+	t.Helper()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+}
+
+// expectStatus fails the test unless resp has the status want
+func expectStatus(t *testing.T, resp *http.Response, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", resp.Request.Method, resp.Request.URL, resp.StatusCode, want, readBody(t, resp))
+	}
+}
+
+// createBooks inserts books with the given titles, in order
+func createBooks(t *testing.T, repo Repository, titles ...string) []*Book {
+	t.Helper()
+	books := make([]*Book, len(titles))
+	for i, title := range titles {
+		books[i] = createBook(t, repo, &Book{Title: title})
+	}
+	return books
+}
+
+// createBook inserts book
+func createBook(t *testing.T, repo Repository, book *Book) *Book {
+	t.Helper()
+	if _, err := repo.CreateBook(context.Background(), book); err != nil {
+		t.Fatalf("create book %q: %v", book.Title, err)
+	}
+	return book
+}
+
+// createAccount inserts an account with the given role
+func createAccount(t *testing.T, repo Repository, name, role string) *Account {
+	t.Helper()
+	account := &Account{Name: name, Email: strings.ToLower(name) + "@example.com", Role: role}
+	if _, err := repo.CreateAccount(context.Background(), account); err != nil {
+		t.Fatalf("create account %q: %v", name, err)
+	}
+	return account
+}
+
+// bookTitles lists the titles of books
+func bookTitles(books []*Book) []string {
+	titles := make([]string, len(books))
+	for i, book := range books {
+		titles[i] = book.Title
+	}
+	return titles
+}
+
+// countCatalog returns the number of books and accounts in repo
+func countCatalog(t *testing.T, repo Repository) (books, accounts int) {
+	t.Helper()
+	ctx := context.Background()
+	page, err := repo.ListBooks(ctx, 1, 0, "", "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := repo.ListAccounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page.TotalCount, len(all)
+}
+
+func TestNewDatabaseCreatesEmptyCatalog(t *testing.T) {
+	books, accounts := countCatalog(t, newTestRepository(t))
+	if books != 0 || accounts != 0 {
+		t.Fatalf("new database has %d books and %d accounts, want none", books, accounts)
+	}
+}
+
+func TestSeedDatabaseIsIdempotent(t *testing.T) {
+	repo := newTestRepository(t)
+	for range 2 {
+		if err := SeedDatabase(context.Background(), repo); err != nil {
+			t.Fatalf("SeedDatabase: %v", err)
+		}
+	}
+
+	books, accounts := countCatalog(t, repo)
+	if books != len(sampleBooks) || accounts != len(sampleAccounts) {
+		t.Fatalf("seeded twice: %d books and %d accounts, want %d and %d", books, accounts, len(sampleBooks), len(sampleAccounts))
+	}
+}
+
+func TestPaginationURLsKeepQuery(t *testing.T) {
+	params := url.Values{"search": {"war and peace"}, "sort": {"title"}, "filter": {""}}
+	pagination := newPagination(2, 5, 20, "/books", params)
+
+	for name, link := range map[string]string{"prev": pagination.PrevURL, "next": pagination.NextURL} {
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatalf("%s URL %q: %v", name, link, err)
+		}
+		query := u.Query()
+		if query.Get("search") != "war and peace" || query.Get("sort") != "title" {
+			t.Errorf("%s URL %q lost the search or sort", name, link)
+		}
+		if query.Has("filter") {
+			t.Errorf("%s URL %q carries the empty filter", name, link)
+		}
+		if strings.Contains(link, " ") {
+			t.Errorf("%s URL %q is not encoded", name, link)
+		}
+	}
+	if !strings.Contains(pagination.NextURL, "page=3") || !strings.Contains(pagination.PrevURL, "page=1") {
+		t.Errorf("page URLs %q and %q point at the wrong pages", pagination.PrevURL, pagination.NextURL)
+	}
+}
+
+func TestOnSaleFilterRespectsSaleEnd(t *testing.T) {
+	repo := newTestRepository(t)
+	ctx := context.Background()
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	createBook(t, repo, &Book{Title: "Active", HasSales: true, SaleEndsAt: &future})
+	expired := createBook(t, repo, &Book{Title: "Expired", HasSales: true, SaleEndsAt: &past})
+	createBook(t, repo, &Book{Title: "Open-ended", HasSales: true})
+
+	result, err := repo.ListBooks(ctx, 10, 0, "", "on_sale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bookTitles(result.Books), []string{"Active", "Open-ended"}; !slices.Equal(got, want) {
+		t.Errorf("on sale: %q, want %q", got, want)
+	}
+
+	book, err := repo.GetBook(ctx, expired.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.HasSales {
+		t.Error("a book whose sale has ended reads as on sale")
+	}
+
+	n, err := repo.ExpireSales(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("ExpireSales took %d books off sale, want 1", n)
+	}
+}
+
+// failingPingRepository is a repository whose database is unreachable
+type failingPingRepository struct {
+	Repository
+	err error
+}
+
+func (r *failingPingRepository) Ping(context.Context) error {
+	return r.err
+}
+
+func TestHealthCheck(t *testing.T) {
+	repo := newTestRepository(t)
+	if err := repo.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	s := newTestServer(t, repo)
+	expectStatus(t, s.get(t, "/healthz", nil), fiber.StatusOK)
+
+	down := errors.New("database is down")
+	failing := &failingPingRepository{Repository: repo, err: down}
+	if err := failing.Ping(context.Background()); !errors.Is(err, down) {
+		t.Fatalf("Ping: %v, want %v", err, down)
+	}
+	s = newTestServer(t, failing)
+	expectStatus(t, s.get(t, "/healthz", nil), fiber.StatusServiceUnavailable)
+}
+
+func TestSuggestTitles(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "Learning Go", "Gone Girl", "Go Programming", "Go Programming", "Rust")
+
+	titles, err := repo.SuggestTitles(context.Background(), "Go", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Go Programming", "Gone Girl", "Learning Go"}; !slices.Equal(titles, want) {
+		t.Errorf("suggestions %q, want %q", titles, want)
+	}
+
+	s := newTestServer(t, repo)
+	resp := s.get(t, "/books/suggest?q=", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	if body := readBody(t, resp); strings.Contains(body, "<option") {
+		t.Errorf("empty query suggested titles: %s", body)
+	}
+
+	resp = s.get(t, "/books/suggest?q=%3Cscript%3E", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+}
+
+func TestAssetManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "css"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "css", "style.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := NewAssetManifest(dir)
+	if err != nil {
+		t.Fatalf("NewAssetManifest: %v", err)
+	}
+	hashed := manifest.Path("css/style.css")
+	if !strings.HasPrefix(hashed, "/static/css/style.") || !strings.HasSuffix(hashed, ".css") || hashed == "/static/css/style.css" {
+		t.Errorf("asset path %q is not hashed", hashed)
+	}
+	if got := manifest.Path("js/missing.js"); got != "/static/js/missing.js" {
+		t.Errorf("unknown asset path %q, want the plain path", got)
+	}
+
+	missing, err := NewAssetManifest(filepath.Join(dir, "nope"))
+	if err != nil {
+		t.Fatalf("NewAssetManifest of a missing dir: %v", err)
+	}
+	if got := missing.Path("css/style.css"); got != "/static/css/style.css" {
+		t.Errorf("empty manifest path %q, want the plain path", got)
+	}
+}
+
+func TestCountBooksByAccount(t *testing.T) {
+	repo := newTestRepository(t)
+	ctx := context.Background()
+	owner := createAccount(t, repo, "Owner", RoleUser)
+	empty := createAccount(t, repo, "Empty", RoleUser)
+	for _, title := range []string{"One", "Two"} {
+		createBook(t, repo, &Book{Title: title, AccountID: &owner.ID})
+	}
+
+	for _, tc := range []struct {
+		name string
+		id   int
+		want int
+	}{
+		{"with books", owner.ID, 2},
+		{"without books", empty.ID, 0},
+		{"missing", 999, 0},
+	} {
+		count, err := repo.CountBooksByAccount(ctx, tc.id)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if count != tc.want {
+			t.Errorf("%s: %d books, want %d", tc.name, count, tc.want)
+		}
+	}
+
+	s := newTestServer(t, repo)
+	resp := s.get(t, fmt.Sprintf("/accounts/%d", owner.ID), nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	if body := readBody(t, resp); !strings.Contains(body, "owns 2 books") {
+		t.Error("account page doesn't show the book count")
+	}
+}
+
+func TestReorderBooks(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "A", "B", "C")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+
+	ids := []int{books[2].ID, books[0].ID, books[1].ID}
+	expectStatus(t, s.postJSON(t, "/books/reorder", fiber.Map{"ids": ids}, admin), fiber.StatusNoContent)
+	result, err := repo.ListBooks(context.Background(), 10, 0, "", "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(result.Books); !slices.Equal(got, []string{"C", "A", "B"}) {
+		t.Errorf("order after reorder %q, want C A B", got)
+	}
+
+	resp := s.postJSON(t, "/books/reorder", fiber.Map{"ids": []int{books[0].ID, 999}}, admin)
+	expectStatus(t, resp, fiber.StatusBadRequest)
+	var body struct {
+		Missing []int `json:"missing"`
+	}
+	decodeJSON(t, resp, &body)
+	if !slices.Equal(body.Missing, []int{999}) {
+		t.Errorf("missing IDs %v, want [999]", body.Missing)
+	}
+}
+
+func TestBookJSONIfModifiedSince(t *testing.T) {
+	repo := newTestRepository(t)
+	book := createBooks(t, repo, "Cached")[0]
+	s := newTestServer(t, repo)
+
+	request := func(since time.Time) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/books/%d", book.ID), nil)
+		req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+		req.Header.Set(fiber.HeaderIfModifiedSince, since.UTC().Format(http.TimeFormat))
+		return s.do(t, req)
+	}
+
+	resp := request(book.UpdatedAt.Add(time.Second))
+	expectStatus(t, resp, fiber.StatusNotModified)
+
+	resp = request(book.UpdatedAt.Add(-time.Hour))
+	expectStatus(t, resp, fiber.StatusOK)
+	if resp.Header.Get(fiber.HeaderLastModified) == "" {
+		t.Error("no Last-Modified header")
+	}
+	var got Book
+	decodeJSON(t, resp, &got)
+	if got.Title != "Cached" {
+		t.Errorf("body has title %q, want Cached", got.Title)
+	}
+}
+
+// observedLogger returns a logger that records every entry at level and above
+func observedLogger(level zapcore.Level) (*zap.Logger, *observer.ObservedLogs) {
+	core, logs := observer.New(level)
+	return zap.New(core), logs
+}
+
+// zeroArgs returns arguments for calling method: a background context,
+// functions that return zero values, pointers to zero values, and zero
+// values for everything else
+func zeroArgs(method reflect.Type) []reflect.Value {
+	contextType := reflect.TypeOf((*context.Context)(nil)).Elem()
+	args := make([]reflect.Value, method.NumIn())
+	for i := range args {
+		in := method.In(i)
+		switch {
+		case in == contextType:
+			args[i] = reflect.ValueOf(context.Background())
+		case in.Kind() == reflect.Func:
+			args[i] = reflect.MakeFunc(in, func([]reflect.Value) []reflect.Value {
+				out := make([]reflect.Value, in.NumOut())
+				for j := range out {
+					out[j] = reflect.Zero(in.Out(j))
+				}
+				return out
+			})
+		case in.Kind() == reflect.Pointer:
+			args[i] = reflect.New(in.Elem())
+		default:
+			args[i] = reflect.Zero(in)
+		}
+	}
+	return args
+}
+
+func TestInstrumentedRepositoryTimesEveryMethod(t *testing.T) {
+	logger, logs := observedLogger(zapcore.DebugLevel)
+	repo := NewInstrumentedRepository(newTestRepository(t), logger, &Config{})
+
+	repoType := reflect.TypeOf((*Repository)(nil)).Elem()
+	value := reflect.ValueOf(repo)
+	for i := range repoType.NumMethod() {
+		method := repoType.Method(i)
+		call := value.MethodByName(method.Name)
+		if method.Type.IsVariadic() {
+			call.CallSlice(zeroArgs(method.Type))
+		} else {
+			call.Call(zeroArgs(method.Type))
+		}
+
+		entries := logs.TakeAll()
+		timed := slices.ContainsFunc(entries, func(entry observer.LoggedEntry) bool {
+			fields := entry.ContextMap()
+			_, hasDuration := fields["duration"]
+			return fields["method"] == method.Name && hasDuration
+		})
+		if !timed {
+			t.Errorf("%s was not timed", method.Name)
+		}
+	}
+}
+
+func TestEmptyStates(t *testing.T) {
+	repo := newTestRepository(t)
+	s := newTestServer(t, repo)
+
+	body := readBody(t, s.get(t, "/books", nil))
+	if !strings.Contains(body, "Add your first book") || strings.Contains(body, "No books match your search") {
+		t.Error("an empty catalog isn't shown as empty")
+	}
+
+	createBooks(t, repo, "Dune")
+	body = readBody(t, s.get(t, "/books?search=zzz", nil))
+	if !strings.Contains(body, "No books match your search") || strings.Contains(body, "Add your first book") {
+		t.Error("a search with no matches isn't shown as no results")
+	}
+}
+
+func TestCreateAccountWithBookRollsBack(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewSQLiteRepository(db, false)
+	ctx := context.Background()
+
+	account := &Account{Name: "Ann", Email: "ann@example.com"}
+	book := &Book{Title: "First"}
+	if err := repo.CreateAccountWithBook(ctx, account, book); err != nil {
+		t.Fatalf("CreateAccountWithBook: %v", err)
+	}
+	if book.AccountID == nil || *book.AccountID != account.ID {
+		t.Errorf("book owner %v, want account %d", book.AccountID, account.ID)
+	}
+
+	if _, err := db.Exec("CREATE TRIGGER reject_books BEFORE INSERT ON books BEGIN SELECT RAISE(ABORT, 'rejected'); END"); err != nil {
+		t.Fatal(err)
+	}
+	err := repo.CreateAccountWithBook(ctx, &Account{Name: "Bob", Email: "bob@example.com"}, &Book{Title: "Second"})
+	if err == nil {
+		t.Fatal("CreateAccountWithBook succeeded although the book insert failed")
+	}
+	accounts, err := repo.ListAccounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 {
+		t.Errorf("%d accounts after a failed onboarding, want 1", len(accounts))
+	}
+}
+
+func TestBulkEditFormShowsWholeSelection(t *testing.T) {
+	repo := newTestRepository(t)
+	query := url.Values{}
+	for i := range 150 {
+		book := createBook(t, repo, &Book{Title: fmt.Sprintf("Bulk book %03d", i)})
+		query.Add("book_ids", strconv.Itoa(book.ID))
+	}
+	s := newTestServer(t, repo)
+
+	resp := s.get(t, "/books/bulk-edit?"+query.Encode(), nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	body := readBody(t, resp)
+	for i := range 150 {
+		if title := fmt.Sprintf("Bulk book %03d", i); !strings.Contains(body, title) {
+			t.Fatalf("form is missing %q", title)
+		}
+	}
+}
+
+func TestListAuthors(t *testing.T) {
+	repo := newTestRepository(t)
+	for _, book := range []*Book{
+		{Title: "Emma", Author: "Jane Austen"},
+		{Title: "Persuasion", Author: "Jane Austen"},
+		{Title: "Dracula", Author: "Bram Stoker"},
+		{Title: "Anonymous"},
+	} {
+		createBook(t, repo, book)
+	}
+	ctx := context.Background()
+
+	authors, err := repo.ListAuthors(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Bram Stoker", "Jane Austen"}; !slices.Equal(authors, want) {
+		t.Errorf("authors %q, want %q", authors, want)
+	}
+
+	result, err := repo.ListBooks(ctx, 10, 0, "", "all", WithAuthor("Jane Austen"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(result.Books); !slices.Equal(got, []string{"Emma", "Persuasion"}) || result.TotalCount != 2 {
+		t.Errorf("books by Jane Austen: %q (total %d)", got, result.TotalCount)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := newTestConfig(t)
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+
+	for name, change := range map[string]func(*Config){
+		"negative page size": func(c *Config) { c.PageSize = -1 },
+		"empty db path":      func(c *Config) { c.DBPath = " " },
+		"bad port":           func(c *Config) { c.Port = "http" },
+		"unknown filter":     func(c *Config) { c.DefaultFilter = "sold_out" },
+		"unknown sort":       func(c *Config) { c.DefaultSort = "color" },
+	} {
+		cfg := *valid
+		change(&cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: config accepted", name)
+		}
+	}
+
+	cfg := *valid
+	cfg.PageSize, cfg.Port = 0, "0"
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "PAGE_SIZE") || !strings.Contains(err.Error(), "PORT") {
+		t.Errorf("errors aren't reported together: %v", err)
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "Dune", "Emma")
+	s := newTestServer(t, repo)
+
+	for _, tc := range []struct {
+		format      string
+		contentType string
+		filename    string
+	}{
+		{"csv", "text/csv", "books.csv"},
+		{"unknown", "text/csv", "books.csv"},
+		{"json", fiber.MIMEApplicationJSON, "books.json"},
+		{"xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "books.xlsx"},
+	} {
+		resp := s.get(t, "/books/export?format="+tc.format, nil)
+		expectStatus(t, resp, fiber.StatusOK)
+		if got := resp.Header.Get(fiber.HeaderContentType); !strings.HasPrefix(got, tc.contentType) {
+			t.Errorf("%s: content type %q, want %q", tc.format, got, tc.contentType)
+		}
+		if got := resp.Header.Get(fiber.HeaderContentDisposition); !strings.Contains(got, tc.filename) {
+			t.Errorf("%s: disposition %q, want %s", tc.format, got, tc.filename)
+		}
+		body := readBody(t, resp)
+
+		switch tc.format {
+		case "json":
+			var books []*Book
+			if err := json.Unmarshal([]byte(body), &books); err != nil {
+				t.Fatalf("json export: %v", err)
+			}
+			if got := bookTitles(books); !slices.Equal(got, []string{"Dune", "Emma"}) {
+				t.Errorf("json export has %q", got)
+			}
+		case "xlsx":
+			archive, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+			if err != nil {
+				t.Fatalf("xlsx export: %v", err)
+			}
+			sheet, err := archive.Open("xl/worksheets/sheet1.xml")
+			if err != nil {
+				t.Fatalf("xlsx export has no sheet: %v", err)
+			}
+			content, _ := io.ReadAll(sheet)
+			if !strings.Contains(string(content), "<t>title</t>") || !strings.Contains(string(content), "<t>Emma</t>") {
+				t.Errorf("xlsx sheet is missing the header or rows: %s", content)
+			}
+		default:
+			records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+			if err != nil {
+				t.Fatalf("csv export: %v", err)
+			}
+			if len(records) != 3 || !slices.Equal(records[0], exportHeader) {
+				t.Errorf("csv export: %q", records)
+			}
+		}
+	}
+}
+
+func TestCompareBooks(t *testing.T) {
+	repo := newTestRepository(t)
+	a := createBook(t, repo, &Book{Title: "Dune", Author: "Frank Herbert"})
+	b := createBook(t, repo, &Book{Title: "Dune Messiah", Author: "Frank Herbert"})
+	c := createBook(t, repo, &Book{Title: "Dune", Author: "Frank Herbert"})
+
+	fields := compareBooks(a, b)
+	differ := map[string]bool{}
+	for _, field := range fields {
+		differ[field.Field] = field.Differ
+	}
+	if !differ["title"] || differ["author"] {
+		t.Errorf("differences %v, want only title", differ)
+	}
+
+	s := newTestServer(t, repo)
+	expectStatus(t, s.get(t, fmt.Sprintf("/books/compare?a=%d&b=%d", a.ID, b.ID), nil), fiber.StatusOK)
+	expectStatus(t, s.get(t, fmt.Sprintf("/books/compare?a=%d&b=999", a.ID), nil), fiber.StatusNotFound)
+	resp := s.get(t, fmt.Sprintf("/books/compare?a=%d&b=%d", a.ID, c.ID), nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	if !strings.Contains(strings.ToLower(readBody(t, resp)), "identical") {
+		t.Error("identical books aren't reported as identical")
+	}
+}
+
+func TestPlay(t *testing.T) {
+	repo := newTestRepository(t)
+	book := createBooks(t, repo, "Now Playing Book")[0]
+	s := newTestServer(t, repo)
+
+	resp := s.get(t, fmt.Sprintf("/play/book/%d", book.ID), nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	if !strings.Contains(readBody(t, resp), "Now Playing Book") {
+		t.Error("play card doesn't show the book")
+	}
+	expectStatus(t, s.get(t, "/play/song/1", nil), fiber.StatusBadRequest)
+	expectStatus(t, s.get(t, "/play/book/999", nil), fiber.StatusNotFound)
+}
+
+func TestNewDatabaseAppliesPragmas(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.DBPath = filepath.Join(t.TempDir(), "app.db")
+	cfg.SQLiteBusyTimeoutMs = 1234
+	db, err := NewDatabase(fxtest.NewLifecycle(t), zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	defer db.Close()
+
+	var journalMode string
+	var synchronous, foreignKeys, busyTimeout int
+	err = db.QueryRow("SELECT * FROM pragma_journal_mode, pragma_synchronous, pragma_foreign_keys, pragma_busy_timeout").
+		Scan(&journalMode, &synchronous, &foreignKeys, &busyTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// synchronous=NORMAL reads back as 1
+	if journalMode != "wal" || synchronous != 1 || foreignKeys != 1 || busyTimeout != 1234 {
+		t.Errorf("pragmas journal_mode=%s synchronous=%d foreign_keys=%d busy_timeout=%d", journalMode, synchronous, foreignKeys, busyTimeout)
+	}
+}
+
+func TestForeignKeyDeletes(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewSQLiteRepository(db, false)
+	ctx := context.Background()
+	owner := createAccount(t, repo, "Owner", RoleUser)
+	owned := createBook(t, repo, &Book{Title: "Owned", AccountID: &owner.ID})
+	tagged := createBooks(t, repo, "Tagged")[0]
+	if err := repo.SetBookTags(ctx, []int{tagged.ID}, []string{"classic"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.DeleteAccount(ctx, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	book, err := repo.GetBook(ctx, owned.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.AccountID != nil {
+		t.Errorf("book still owned by %d after its account was deleted", *book.AccountID)
+	}
+
+	if _, err := repo.DeleteBooks(ctx, []int{tagged.ID}); err != nil {
+		t.Fatal(err)
+	}
+	var links int
+	if err := db.QueryRow("SELECT COUNT(*) FROM book_tags WHERE book_id = ?", tagged.ID).Scan(&links); err != nil {
+		t.Fatal(err)
+	}
+	if links != 0 {
+		t.Errorf("%d tag links left for a deleted book", links)
+	}
+}
+
+func TestBulkDryRun(t *testing.T) {
+	repo := newTestRepository(t)
+	onSale := createBook(t, repo, &Book{Title: "Already on sale", HasSales: true})
+	offSale := createBook(t, repo, &Book{Title: "Not on sale"})
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+	ids := []string{strconv.Itoa(onSale.ID), strconv.Itoa(offSale.ID)}
+
+	resp := s.postForm(t, "/books/bulk-update-sales", url.Values{"action": {"add"}, "dry_run": {"true"}, "book_ids": ids}, admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	body := readBody(t, resp)
+	if !strings.Contains(body, "1 book(s) would change, 1 already up to date") || !strings.Contains(body, "Not on sale") {
+		t.Errorf("sales preview: %s", body)
+	}
+
+	resp = s.postForm(t, "/books/delete", url.Values{"dry_run": {"true"}, "book_ids": ids}, admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	if body := readBody(t, resp); !strings.Contains(body, "2 book(s) would change") {
+		t.Errorf("delete preview: %s", body)
+	}
+
+	books, err := repo.GetBooksByIDs(context.Background(), []int{onSale.ID, offSale.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 2 || books[1].HasSales {
+		t.Error("a dry run changed the books")
+	}
+}
+
+func TestAvatarHelpers(t *testing.T) {
+	if avatarColor("ann@example.com") != avatarColor(" ANN@example.com ") {
+		t.Error("the same email gives different colors")
+	}
+	if avatarColor("ann@example.com") == avatarColor("bob@example.com") {
+		t.Error("different emails share a color")
+	}
+	for name, want := range map[string]string{"ann": "A", "Ann Lee": "AL", "ann marie lee": "AL", "  ": "?", "élodie": "É"} {
+		if got := initials(name); got != want {
+			t.Errorf("initials(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDefaultSort(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "B", "A", "C")
+	s := newTestServer(t, repo, func(c *Config) { c.DefaultSort = "title" })
+
+	list := func(path string) []string {
+		resp := s.get(t, path, nil)
+		expectStatus(t, resp, fiber.StatusOK)
+		var books []*Book
+		decodeJSON(t, resp, &books)
+		return bookTitles(books)
+	}
+	if got := list("/books/export?format=json"); !slices.Equal(got, []string{"A", "B", "C"}) {
+		t.Errorf("default sort gave %q, want A B C", got)
+	}
+	if got := list("/books/export?format=json&sort=manual"); !slices.Equal(got, []string{"B", "A", "C"}) {
+		t.Errorf("explicit sort gave %q, want B A C", got)
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	repo := newTestRepository(t)
+	ctx := context.Background()
+	failure := errors.New("stop")
+
+	err := repo.WithTx(ctx, func(txRepo Repository) error {
+		if _, err := txRepo.CreateBook(ctx, &Book{Title: "Rolled back"}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("WithTx returned %v, want the callback's error", err)
+	}
+	if count, _ := repo.CountBooks(ctx); count != 0 {
+		t.Errorf("%d books after a rolled back transaction, want 0", count)
+	}
+
+	err = repo.WithTx(ctx, func(txRepo Repository) error {
+		_, err := txRepo.CreateBook(ctx, &Book{Title: "Committed"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := repo.CountBooks(ctx); count != 1 {
+		t.Errorf("%d books after a committed transaction, want 1", count)
+	}
+}
+
+// slowRepository delays CountBooks to look like a slow query
+type slowRepository struct {
+	Repository
+	delay time.Duration
+}
+
+func (r *slowRepository) CountBooks(ctx context.Context) (int, error) {
+	time.Sleep(r.delay)
+	return r.Repository.CountBooks(ctx)
+}
+
+func TestSlowRepositoryCallWarning(t *testing.T) {
+	for _, tc := range []struct {
+		delay time.Duration
+		warn  bool
+	}{
+		{50 * time.Millisecond, true},
+		{0, false},
+	} {
+		logger, logs := observedLogger(zapcore.WarnLevel)
+		inner := &slowRepository{Repository: newTestRepository(t), delay: tc.delay}
+		repo := NewInstrumentedRepository(inner, logger, &Config{SlowQueryThreshold: 20 * time.Millisecond})
+		if _, err := repo.CountBooks(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		warnings := logs.FilterMessage("Slow repository call").All()
+		if !tc.warn {
+			if len(warnings) != 0 {
+				t.Errorf("delay %s: warned although under the threshold", tc.delay)
+			}
+			continue
+		}
+		if len(warnings) != 1 {
+			t.Fatalf("delay %s: %d warnings, want 1", tc.delay, len(warnings))
+		}
+		fields := warnings[0].ContextMap()
+		if fields["method"] != "CountBooks" || fields["duration"] == nil {
+			t.Errorf("warning fields %v lack the method or duration", fields)
+		}
+	}
+}
+
+func TestHeadBook(t *testing.T) {
+	repo := newTestRepository(t)
+	book := createBooks(t, repo, "Exists")[0]
+	s := newTestServer(t, repo)
+
+	for path, want := range map[string]int{
+		fmt.Sprintf("/books/%d", book.ID): fiber.StatusOK,
+		"/books/999":                      fiber.StatusNotFound,
+	} {
+		resp := s.do(t, httptest.NewRequest(http.MethodHead, path, nil))
+		expectStatus(t, resp, want)
+		if body := readBody(t, resp); body != "" {
+			t.Errorf("HEAD %s has a body: %q", path, body)
+		}
+	}
+}
+
+// postFile uploads content as the named file field of a multipart form
+func (s *testServer) postFile(t *testing.T, path, field, filename, content string, account *Account) *http.Response {
+	t.Helper()
+	var body strings.Builder
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile(field, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, content)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body.String()))
+	req.Header.Set(fiber.HeaderContentType, form.FormDataContentType())
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	s.signIn(req, account)
+	return s.do(t, req)
+}
+
+func TestImportAccounts(t *testing.T) {
+	repo := newTestRepository(t)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+
+	resp := s.postFile(t, "/accounts/import", "file", "accounts.csv", "name,email\nAnn,ann@example.com\nBob,bob@example.com\n", admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	var summary AccountImportSummary
+	decodeJSON(t, resp, &summary)
+	if summary.Imported != 2 || summary.Failed != 0 {
+		t.Errorf("clean import: %+v", summary)
+	}
+
+	resp = s.postFile(t, "/accounts/import", "file", "accounts.csv", "Ann Again,ANN@example.com\nCarl,carl@\nDee,dee@example.com\n", admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	summary = AccountImportSummary{}
+	decodeJSON(t, resp, &summary)
+	if summary.Imported != 1 || summary.Failed != 2 {
+		t.Fatalf("import with bad rows: %+v", summary)
+	}
+	if !strings.Contains(summary.Rows[0].Error, "already in use") || !strings.Contains(summary.Rows[1].Error, "not a valid") || !summary.Rows[2].OK {
+		t.Errorf("row outcomes: %+v %+v %+v", summary.Rows[0], summary.Rows[1], summary.Rows[2])
+	}
+
+	accounts, err := repo.ListAccounts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 4 {
+		t.Errorf("%d accounts after the imports, want 4", len(accounts))
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	s := newTestServer(t, newTestRepository(t), func(c *Config) { c.RequestIDHeader = "X-Correlation-ID" })
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Header.Set("X-Correlation-ID", "abc-123")
+	resp := s.do(t, req)
+	if got := resp.Header.Get("X-Correlation-ID"); got != "abc-123" {
+		t.Errorf("X-Correlation-ID %q, want abc-123", got)
+	}
+	if got := resp.Header.Get(fiber.HeaderXRequestID); got != "" {
+		t.Errorf("X-Request-ID is set too: %q", got)
+	}
+}
+
+func TestHighlightTitle(t *testing.T) {
+	for _, tc := range []struct{ title, search, want string }{
+		{"Learning Go", "go", "Learning <mark>Go</mark>"},
+		{"Go go GO", "go", "<mark>Go</mark> <mark>go</mark> <mark>GO</mark>"},
+		{"<b>Go</b>", "go", "&lt;b&gt;<mark>Go</mark>&lt;/b&gt;"},
+		{"Fish & Chips", "&", "Fish <mark>&amp;</mark> Chips"},
+		{"Dune", "", "Dune"},
+		// ẞ and ß fold together but differ in length, as do the Kelvin sign and k
+		{"STRAẞE", "straße", "<mark>STRAẞE</mark>"},
+		{"Die Straße", "STRAẞE", "Die <mark>Straße</mark>"},
+		{"5 \u212a", "k", "5 <mark>\u212a</mark>"},
+	} {
+		if got := string(highlightTitle(tc.title, tc.search)); got != tc.want {
+			t.Errorf("highlightTitle(%q, %q) = %q, want %q", tc.title, tc.search, got, tc.want)
+		}
+	}
+}
+
+// offsetRecordingRepository records the offsets ListBooks is called with
+type offsetRecordingRepository struct {
+	Repository
+	offsets []int
+}
+
+func (r *offsetRecordingRepository) ListBooks(ctx context.Context, limit, offset int, search, filter string, opts ...ListOption) (*PaginatedBooks, error) {
+	r.offsets = append(r.offsets, offset)
+	return r.Repository.ListBooks(ctx, limit, offset, search, filter, opts...)
+}
+
+func TestPageIsClamped(t *testing.T) {
+	inner := newTestRepository(t)
+	for i := range 12 {
+		createBook(t, inner, &Book{Title: fmt.Sprintf("Book %02d", i)})
+	}
+	repo := &offsetRecordingRepository{Repository: inner}
+	s := newTestServer(t, repo, func(c *Config) {
+		c.PageSize = 5
+		c.MaxPage = 50
+	})
+
+	resp := s.get(t, "/api/books?envelope=page&page=1000000", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	var page BookPage
+	decodeJSON(t, resp, &page)
+	if page.Page != 3 || len(page.Items) != 2 {
+		t.Errorf("page %d with %d books, want the last page, 3, with 2", page.Page, len(page.Items))
+	}
+	if max := (s.cfg.MaxPage - 1) * s.cfg.PageSize; slices.Max(repo.offsets) > max {
+		t.Errorf("offsets %v go past %d", repo.offsets, max)
+	}
+}
+
+func TestRenameAuthor(t *testing.T) {
+	repo := newTestRepository(t)
+	for _, book := range []*Book{
+		{Title: "Emma", Author: "Jane Austin"},
+		{Title: "Persuasion", Author: "Jane Austin"},
+		{Title: "Dracula", Author: "Bram Stoker"},
+	} {
+		createBook(t, repo, book)
+	}
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+
+	req := httptest.NewRequest(http.MethodPost, "/books/rename-author", strings.NewReader(url.Values{"from": {"Jane Austin"}, "to": {"Jane Austen"}}.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	s.signIn(req, admin)
+	resp := s.do(t, req)
+	expectStatus(t, resp, fiber.StatusOK)
+	var body struct {
+		Renamed int64 `json:"renamed"`
+	}
+	decodeJSON(t, resp, &body)
+	if body.Renamed != 2 {
+		t.Errorf("renamed %d books, want 2", body.Renamed)
+	}
+
+	authors, err := repo.ListAuthors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Bram Stoker", "Jane Austen"}; !slices.Equal(authors, want) {
+		t.Errorf("authors after rename %q, want %q", authors, want)
+	}
+	expectStatus(t, s.postForm(t, "/books/rename-author", url.Values{"from": {"Jane Austen"}}, admin), fiber.StatusBadRequest)
+}
+
+func TestAPIListEnvelopes(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "A", "B", "C", "D", "E")
+	s := newTestServer(t, repo)
+
+	resp := s.get(t, "/api/books?envelope=true&per_page=2", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	var envelope BookListEnvelope
+	decodeJSON(t, resp, &envelope)
+	if want := (BookListMeta{Page: 1, PerPage: 2, Total: 5, TotalPages: 3}); envelope.Meta != want || len(envelope.Data) != 2 {
+		t.Errorf("envelope meta %+v with %d books, want %+v with 2", envelope.Meta, len(envelope.Data), want)
+	}
+
+	resp = s.get(t, "/api/books?envelope=page&per_page=2&page=2", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	var page BookPage
+	decodeJSON(t, resp, &page)
+	if page.Total != 5 || page.Page != 2 || page.TotalPages != 3 || !page.HasNext || !page.HasPrev || len(page.Items) != 2 {
+		t.Errorf("page %+v", page)
+	}
+
+	resp = s.get(t, "/api/books", nil)
+	var bare []*Book
+	decodeJSON(t, resp, &bare)
+	if len(bare) != s.cfg.PageSize {
+		t.Errorf("bare list has %d books, want %d", len(bare), s.cfg.PageSize)
+	}
+}
+
+func TestNewBookPage(t *testing.T) {
+	for _, tc := range []struct{ page, perPage, total int }{
+		{1, 5, 0}, {1, 5, 5}, {2, 5, 11}, {3, 5, 11},
+	} {
+		pagination := newPagination(tc.page, tc.perPage, tc.total, "/api/books", nil)
+		page := newBookPage(&PaginatedBooks{TotalCount: tc.total}, pagination)
+		wantPages := (tc.total + tc.perPage - 1) / tc.perPage
+		if page.Total != tc.total || page.Page != tc.page || page.TotalPages != wantPages ||
+			page.HasNext != (tc.page < wantPages) || page.HasPrev != (tc.page > 1) || page.Items == nil {
+			t.Errorf("page %d of %d books: %+v", tc.page, tc.total, page)
+		}
+	}
+}
+
+func TestProcessedCleaner(t *testing.T) {
+	importDir := t.TempDir()
+	processed := filepath.Join(importDir, "processed")
+	if err := os.MkdirAll(filepath.Join(processed, "keep"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	files := map[string]time.Duration{
+		filepath.Join(processed, "old.txt"):     48 * time.Hour,
+		filepath.Join(processed, "recent.txt"):  time.Hour,
+		filepath.Join(importDir, "waiting.txt"): 48 * time.Hour,
+	}
+	for path, age := range files {
+		if err := os.WriteFile(path, []byte("title"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cleaner := &ProcessedCleaner{dir: processed, retention: 24 * time.Hour, logger: zap.NewNop()}
+	removed, err := cleaner.Clean(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d files, want 1", removed)
+	}
+	for path := range files {
+		_, err := os.Stat(path)
+		if gone := errors.Is(err, fs.ErrNotExist); gone != (filepath.Base(path) == "old.txt") {
+			t.Errorf("%s: removed=%v", path, gone)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(processed, "keep")); err != nil {
+		t.Errorf("subdirectory was removed: %v", err)
+	}
+}
+
+func TestBuildLoggerFallback(t *testing.T) {
+	failing := func(...zap.Option) (*zap.Logger, error) { return nil, errors.New("no sink") }
+
+	logger, err := buildLogger(failing, false)
+	if err != nil || logger == nil {
+		t.Fatalf("buildLogger: %v, %v; want the fallback logger", logger, err)
+	}
+	logger.Info("fallback logger works")
+
+	if _, err := buildLogger(failing, true); err == nil {
+		t.Error("strict buildLogger didn't return the error")
+	}
+}
+
+func TestFeaturedBooks(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "Plain", "Star")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+	ctx := context.Background()
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/books/%d/feature", books[1].ID), nil)
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	s.signIn(req, admin)
+	resp := s.do(t, req)
+	expectStatus(t, resp, fiber.StatusOK)
+
+	featured, err := repo.ListFeatured(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(featured); !slices.Equal(got, []string{"Star"}) {
+		t.Errorf("featured %q, want Star", got)
+	}
+	body := readBody(t, s.get(t, "/", nil))
+	if !strings.Contains(body, "Star") {
+		t.Error("home page doesn't show the featured book")
+	}
+
+	if featured, err := repo.ToggleFeatured(ctx, books[1].ID); err != nil || featured {
+		t.Errorf("second toggle: featured=%v, %v", featured, err)
+	}
+	if featured, _ := repo.ListFeatured(ctx, 10); len(featured) != 0 {
+		t.Errorf("unfeatured book is still listed")
+	}
+}
+
+func TestBookChangesPaging(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "A", "B", "C", "D", "E")
+	s := newTestServer(t, repo)
+
+	var seen []int
+	path := "/api/books/changes?limit=2"
+	for range len(books) + 1 {
+		resp := s.get(t, path, nil)
+		expectStatus(t, resp, fiber.StatusOK)
+		var changes BookChanges
+		decodeJSON(t, resp, &changes)
+		for _, book := range changes.Items {
+			seen = append(seen, book.ID)
+		}
+		if changes.NextCursor == "" {
+			break
+		}
+		path = "/api/books/changes?limit=2&cursor=" + url.QueryEscape(changes.NextCursor)
+	}
+
+	want := make([]int, len(books))
+	for i, book := range books {
+		want[i] = book.ID
+	}
+	if !slices.Equal(seen, want) {
+		t.Errorf("paged through %v, want %v", seen, want)
+	}
+
+	for _, limit := range []string{"0", "501", "ten"} {
+		expectStatus(t, s.get(t, "/api/books/changes?limit="+limit, nil), fiber.StatusBadRequest)
+	}
+}
+
+func TestQueryInt(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString(strconv.Itoa(queryInt(c, "n", 5, 1, 10)))
+	})
+	for query, want := range map[string]string{
+		"":       "5",
+		"?n=7":   "7",
+		"?n=0":   "1",
+		"?n=-3":  "1",
+		"?n=99":  "10",
+		"?n=abc": "5",
+		"?n=2.5": "5",
+	} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(t, resp); got != want {
+			t.Errorf("queryInt for %q = %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestCreateBookHTMXRow(t *testing.T) {
+	repo := newTestRepository(t)
+	s := newTestServer(t, repo)
+
+	req := httptest.NewRequest(http.MethodPost, "/books/create", strings.NewReader(url.Values{"title": {"Fresh Row"}}.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	req.Header.Set("HX-Request", "true")
+	resp := s.do(t, req)
+	expectStatus(t, resp, fiber.StatusOK)
+	if resp.Header.Get("HX-Trigger") != "book-created" {
+		t.Errorf("HX-Trigger %q, want book-created", resp.Header.Get("HX-Trigger"))
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "<tr") || !strings.Contains(body, "Fresh Row") {
+		t.Errorf("response isn't the new row: %s", body)
+	}
+
+	resp = s.postForm(t, "/books/create", url.Values{"title": {"Redirected"}}, nil)
+	expectStatus(t, resp, fiber.StatusFound)
+}
+
+func TestRedactedEmail(t *testing.T) {
+	for email, want := range map[string]string{
+		"john@example.com": "j***@example.com",
+		"a@example.com":    "a***@example.com",
+		"élise@example.fr": "é***@example.fr",
+		"@example.com":     "***@example.com",
+		"not-an-email":     "***",
+	} {
+		if got := redactedEmail(email).String; got != want {
+			t.Errorf("redactedEmail(%q) = %q, want %q", email, got, want)
+		}
+	}
+
+	h := &Handler{cfg: &Config{RedactEmails: true}}
+	if got := h.emailField("john@example.com").String; got != "j***@example.com" {
+		t.Errorf("redacted field %q", got)
+	}
+	h.cfg.RedactEmails = false
+	if got := h.emailField("john@example.com").String; got != "john@example.com" {
+		t.Errorf("unredacted field %q", got)
+	}
+}
+
+func TestBookSummary(t *testing.T) {
+	repo := newTestRepository(t)
+	ended := time.Now().Add(-time.Hour)
+	for _, book := range []*Book{
+		{Title: "On sale", HasSales: true},
+		{Title: "Also on sale", HasSales: true},
+		{Title: "Sale ended", HasSales: true, SaleEndsAt: &ended},
+		{Title: "Full price"},
+	} {
+		createBook(t, repo, book)
+	}
+	s := newTestServer(t, repo)
+
+	resp := s.get(t, "/api/books/summary", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	var summary map[string]int
+	decodeJSON(t, resp, &summary)
+	if summary["on_sale"] != 2 || summary["not_on_sale"] != 2 {
+		t.Errorf("summary %v, want 2 on sale and 2 not", summary)
+	}
+}
+
+func TestSPAFallback(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"index.html": "<div id=app></div>", "app.js": "console.log(1)"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer(t, newTestRepository(t), func(c *Config) {
+		c.SPAPrefix = "/app"
+		c.SPADir = dir
+	})
+
+	for path, want := range map[string]string{
+		"/app/app.js":         "console.log(1)",
+		"/app/foo":            "<div id=app></div>",
+		"/app/../main.go":     "<div id=app></div>",
+		"/app/settings/users": "<div id=app></div>",
+	} {
+		resp := s.get(t, path, nil)
+		expectStatus(t, resp, fiber.StatusOK)
+		if body := readBody(t, resp); body != want {
+			t.Errorf("%s served %q, want %q", path, body, want)
+		}
+	}
+	expectStatus(t, s.get(t, "/api/books", nil), fiber.StatusOK)
+}
+
+func TestSetSalesByFilter(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "Go in Action", "Learning Go", "Dune")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+
+	req := httptest.NewRequest(http.MethodPost, "/books/bulk-sales-by-filter", strings.NewReader(url.Values{"action": {"add"}, "search": {"go"}}.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	s.signIn(req, admin)
+	resp := s.do(t, req)
+	expectStatus(t, resp, fiber.StatusOK)
+	var body struct {
+		Updated int64 `json:"updated"`
+	}
+	decodeJSON(t, resp, &body)
+	if body.Updated != 2 {
+		t.Errorf("updated %d books, want 2", body.Updated)
+	}
+
+	result, err := repo.ListBooks(context.Background(), 10, 0, "", "on_sale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(result.Books); !slices.Equal(got, []string{"Go in Action", "Learning Go"}) {
+		t.Errorf("on sale: %q", got)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "Dune")
+	s := newTestServer(t, repo)
+
+	resp := s.do(t, httptest.NewRequest(http.MethodPut, "/books/1", nil))
+	expectStatus(t, resp, fiber.StatusMethodNotAllowed)
+	allowed := strings.Split(strings.ReplaceAll(resp.Header.Get(fiber.HeaderAllow), " ", ""), ",")
+	for _, method := range []string{fiber.MethodGet, fiber.MethodHead, fiber.MethodPost} {
+		if !slices.Contains(allowed, method) {
+			t.Errorf("Allow %q is missing %s", allowed, method)
+		}
+	}
+	if slices.Contains(allowed, fiber.MethodPut) {
+		t.Errorf("Allow %q lists PUT", allowed)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/books/1", nil)
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	resp = s.do(t, req)
+	expectStatus(t, resp, fiber.StatusMethodNotAllowed)
+	var body map[string]string
+	decodeJSON(t, resp, &body)
+	if body["error"] == "" {
+		t.Error("JSON 405 has no error message")
+	}
+}
+
+// pngHeader is enough of a PNG for content sniffing to recognize it
+const pngHeader = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+func TestUploadCover(t *testing.T) {
+	repo := newTestRepository(t)
+	book := createBooks(t, repo, "Dune")[0]
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo, func(c *Config) { c.MaxCoverBytes = 1024 })
+	path := fmt.Sprintf("/books/%d/cover", book.ID)
+
+	resp := s.postFile(t, path, "cover", "cover.png", pngHeader, admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	var body struct {
+		CoverPath string `json:"cover_path"`
+	}
+	decodeJSON(t, resp, &body)
+	if !uploadName.MatchString(body.CoverPath) {
+		t.Errorf("stored name %q isn't generated", body.CoverPath)
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.UploadsDir, body.CoverPath)); err != nil {
+		t.Errorf("cover wasn't stored: %v", err)
+	}
+	if stored, _ := repo.GetBook(context.Background(), book.ID); stored.CoverPath != body.CoverPath {
+		t.Errorf("recorded cover %q, want %q", stored.CoverPath, body.CoverPath)
+	}
+
+	expectStatus(t, s.postFile(t, path, "cover", "cover.png", "just some text", admin), fiber.StatusUnsupportedMediaType)
+	expectStatus(t, s.postFile(t, path, "cover", "cover.png", pngHeader+strings.Repeat("x", 2048), admin), fiber.StatusRequestEntityTooLarge)
+
+	user := createAccount(t, repo, "User", RoleUser)
+	expectStatus(t, s.postFile(t, path, "cover", "cover.png", pngHeader, user), fiber.StatusForbidden)
+}
+
+func TestServeUpload(t *testing.T) {
+	s := newTestServer(t, newTestRepository(t))
+	name := strings.Repeat("ab", 16) + ".png"
+	if err := os.WriteFile(filepath.Join(s.cfg.UploadsDir, name), []byte(pngHeader), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := s.get(t, "/uploads/"+name, nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	if got := resp.Header.Get(fiber.HeaderContentType); got != "image/png" {
+		t.Errorf("content type %q, want image/png", got)
+	}
+	for _, path := range []string{"/uploads/..%2Fmain.go", "/uploads/..%2F..%2Fetc%2Fpasswd", "/uploads/notes.txt"} {
+		expectStatus(t, s.get(t, path, nil), fiber.StatusBadRequest)
+	}
+	expectStatus(t, s.get(t, "/uploads/"+strings.Repeat("cd", 16)+".png", nil), fiber.StatusNotFound)
+}
+
+func TestLinkHeader(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "A", "B", "C", "D", "E")
+	s := newTestServer(t, repo)
+
+	links := func(page int) map[string]string {
+		resp := s.get(t, fmt.Sprintf("/api/books?per_page=2&search=&page=%d", page), nil)
+		expectStatus(t, resp, fiber.StatusOK)
+		rels := map[string]string{}
+		for _, link := range strings.Split(resp.Header.Get(fiber.HeaderLink), ", ") {
+			target, rel, _ := strings.Cut(link, "; ")
+			rels[strings.Trim(strings.TrimPrefix(rel, "rel="), `"`)] = strings.Trim(target, "<>")
+		}
+		return rels
+	}
+
+	middle := links(2)
+	for rel, page := range map[string]string{"first": "1", "prev": "1", "next": "3", "last": "3"} {
+		target, err := url.Parse(middle[rel])
+		if err != nil || target.Host == "" {
+			t.Errorf("%s link %q isn't absolute", rel, middle[rel])
+			continue
+		}
+		if target.Path != "/api/books" || target.Query().Get("page") != page || target.Query().Get("per_page") != "2" {
+			t.Errorf("%s link %q, want page %s of /api/books", rel, middle[rel], page)
+		}
+	}
+	if first := links(1); first["prev"] != "" || first["next"] == "" {
+		t.Errorf("first page links %v", first)
+	}
+	if last := links(3); last["next"] != "" || last["prev"] == "" {
+		t.Errorf("last page links %v", last)
+	}
+}
+
+func TestBulkResultReportsFailures(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "A", "B")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+
+	form := url.Values{"book_ids": {strconv.Itoa(books[0].ID), "999", strconv.Itoa(books[1].ID)}}
+	req := httptest.NewRequest(http.MethodPost, "/books/delete", strings.NewReader(form.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	s.signIn(req, admin)
+	resp := s.do(t, req)
+	expectStatus(t, resp, fiber.StatusOK)
+	var result BulkResult
+	decodeJSON(t, resp, &result)
+	if !slices.Equal(result.Succeeded, []int{books[0].ID, books[1].ID}) || len(result.Failed) != 1 || result.Failed[0].ID != 999 {
+		t.Errorf("result %+v, want 999 failed and the rest succeeded", result)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/books/delete", strings.NewReader(url.Values{"book_ids": {"999"}}.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	req.Header.Set("HX-Request", "true")
+	s.signIn(req, admin)
+	resp = s.do(t, req)
+	expectStatus(t, resp, fiber.StatusOK)
+	if body := readBody(t, resp); !strings.Contains(body, "999") {
+		t.Errorf("summary doesn't name the failed book: %s", body)
+	}
+}
+
+func TestSiteMeta(t *testing.T) {
+	s := newTestServer(t, newTestRepository(t), func(c *Config) {
+		c.Site = SiteMeta{Title: "Shelfware", Description: "Books, mostly", FaviconPath: "/static/shelf.ico"}
+	})
+	for _, path := range []string{"/", "/books", "/accounts"} {
+		body := readBody(t, s.get(t, path, nil))
+		if !strings.Contains(body, "Shelfware</title>") || !strings.Contains(body, `<link rel="icon" href="/static/shelf.ico">`) {
+			t.Errorf("%s doesn't carry the site title and favicon", path)
+		}
+	}
+}
+
+func TestFindPotentialDuplicates(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "The Hobbit", "Dune", "the hobbit!", "Emma", "  THE Hobbit ", "Dune.")
+	clusters, err := repo.FindPotentialDuplicates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("%d clusters, want 2", len(clusters))
+	}
+	if got := bookTitles(clusters[0]); !slices.Equal(got, []string{"Dune", "Dune."}) {
+		t.Errorf("first cluster %q", got)
+	}
+	if got := bookTitles(clusters[1]); !slices.Equal(got, []string{"The Hobbit", "the hobbit!", "  THE Hobbit "}) {
+		t.Errorf("second cluster %q", got)
+	}
+
+	s := newTestServer(t, repo)
+	resp := s.get(t, "/books/duplicates", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	if body := readBody(t, resp); !strings.Contains(body, "the hobbit!") || strings.Contains(body, "Emma") {
+		t.Error("duplicates page lists the wrong books")
+	}
+}
+
+func TestImportBuffer(t *testing.T) {
+	repo := newTestRepository(t)
+	ctx := context.Background()
+	saved := 0
+	buffer := NewImportBuffer(repo, 500, func(books []*Book) { saved += len(books) })
+	for i := range 2500 {
+		if err := buffer.Add(ctx, &Book{Title: fmt.Sprintf("Imported %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := buffer.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if buffer.Flushes() != 5 || saved != 2500 {
+		t.Errorf("%d flushes saving %d books, want 5 saving 2500", buffer.Flushes(), saved)
+	}
+	if count, _ := repo.CountBooks(ctx); count != 2500 {
+		t.Errorf("%d books stored, want 2500", count)
+	}
+
+	buffer = NewImportBuffer(repo, 500, func([]*Book) {})
+	buffer.Add(ctx, &Book{Title: "Leftover"})
+	buffer.Close(ctx)
+	if buffer.Flushes() != 1 {
+		t.Errorf("closing a part-full buffer made %d flushes, want 1", buffer.Flushes())
+	}
+}
+
+// setPassword gives account the password, hashed at the lowest cost
+func setPassword(t *testing.T, repo Repository, account *Account, password string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetAccountPassword(context.Background(), account.ID, string(hash)); err != nil {
+		t.Fatal(err)
+	}
+	account.PasswordHash = string(hash)
+}
+
+// sessionCookieOf returns the session cookie set by resp, if any
+func sessionCookieOf(resp *http.Response) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestRoles(t *testing.T) {
+	repo := newTestRepository(t)
+	user := createAccount(t, repo, "User", RoleUser)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+
+	if stored, _ := repo.GetAccount(context.Background(), user.ID); stored.Role != RoleUser {
+		t.Errorf("stored role %q, want %q", stored.Role, RoleUser)
+	}
+	expectStatus(t, s.get(t, "/admin/integrity", user), fiber.StatusForbidden)
+	expectStatus(t, s.get(t, "/admin/integrity", admin), fiber.StatusOK)
+	expectStatus(t, s.postForm(t, "/books/delete", url.Values{"book_ids": {"1"}}, user), fiber.StatusForbidden)
+
+	book := createBooks(t, repo, "Dune")[0]
+	other := createAccount(t, repo, "Other", RoleUser)
+	for _, path := range []string{
+		"/books/reorder",
+		fmt.Sprintf("/books/%d/feature", book.ID),
+		fmt.Sprintf("/books/%d/archive", book.ID),
+		fmt.Sprintf("/books/%d/unarchive", book.ID),
+		fmt.Sprintf("/books/%d/cover", book.ID),
+		"/accounts/import",
+		fmt.Sprintf("/accounts/%d/delete", other.ID),
+	} {
+		form := url.Values{"book_ids": {strconv.Itoa(book.ID)}}
+		expectStatus(t, s.postForm(t, path, form, nil), fiber.StatusUnauthorized)
+		expectStatus(t, s.postForm(t, path, form, user), fiber.StatusForbidden)
+		if resp := s.postForm(t, path, form, admin); resp.StatusCode == fiber.StatusUnauthorized || resp.StatusCode == fiber.StatusForbidden {
+			t.Errorf("%s: admin got %d", path, resp.StatusCode)
+		}
+	}
+	if stored, _ := repo.GetBook(context.Background(), book.ID); !stored.Featured || stored.Archived {
+		t.Errorf("only the admin's requests should apply: featured=%v archived=%v", stored.Featured, stored.Archived)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	repo := newTestRepository(t)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	setPassword(t, repo, admin, "correct horse")
+	s := newTestServer(t, repo)
+
+	resp := s.postForm(t, "/login", url.Values{"email": {"admin@example.com"}, "password": {"wrong"}}, nil)
+	expectStatus(t, resp, fiber.StatusUnauthorized)
+	if sessionCookieOf(resp) != nil {
+		t.Error("a wrong password started a session")
+	}
+
+	resp = s.postForm(t, "/login", url.Values{"email": {"admin@example.com"}, "password": {"correct horse"}, "next": {"/admin/integrity"}}, nil)
+	expectStatus(t, resp, fiber.StatusFound)
+	if got := resp.Header.Get(fiber.HeaderLocation); got != "/admin/integrity" {
+		t.Errorf("redirected to %q, want /admin/integrity", got)
+	}
+	cookie := sessionCookieOf(resp)
+	if cookie == nil {
+		t.Fatal("no session cookie")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/integrity", nil)
+	req.AddCookie(cookie)
+	expectStatus(t, s.do(t, req), fiber.StatusOK)
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/integrity", nil)
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	expectStatus(t, s.do(t, req), fiber.StatusUnauthorized)
+	resp = s.get(t, "/admin/integrity", nil)
+	expectStatus(t, resp, fiber.StatusFound)
+	if got := resp.Header.Get(fiber.HeaderLocation); got != "/login?next=%2Fadmin%2Fintegrity" {
+		t.Errorf("anonymous page request sent to %q", got)
+	}
+
+	resp = s.postForm(t, "/logout", nil, admin)
+	if cookie := sessionCookieOf(resp); cookie == nil || cookie.Value != "" {
+		t.Error("logout didn't clear the session cookie")
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	repo := newTestRepository(t)
+	account := createAccount(t, repo, "Ann", RoleUser)
+	setPassword(t, repo, account, "old password")
+	s := newTestServer(t, repo)
+	path := fmt.Sprintf("/accounts/%d/password", account.ID)
+	change := func(current, password, confirm string) *http.Response {
+		return s.postForm(t, path, url.Values{"current_password": {current}, "new_password": {password}, "confirm_password": {confirm}}, account)
+	}
+
+	expectStatus(t, change("wrong", "new password", "new password"), fiber.StatusUnauthorized)
+	expectStatus(t, change("old password", "short", "short"), fiber.StatusBadRequest)
+	expectStatus(t, change("old password", "new password", "other password"), fiber.StatusBadRequest)
+	expectStatus(t, change("old password", "new password", "new password"), fiber.StatusOK)
+
+	stored, err := repo.GetAccount(context.Background(), account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored.PasswordHash), []byte("new password")) != nil {
+		t.Error("the new password wasn't stored")
+	}
+
+	other := createAccount(t, repo, "Bob", RoleUser)
+	expectStatus(t, s.postForm(t, path, url.Values{"current_password": {"x"}}, other), fiber.StatusForbidden)
+}
+
+func TestSessionLifetimes(t *testing.T) {
+	repo := newTestRepository(t)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	setPassword(t, repo, admin, "correct horse")
+	s := newTestServer(t, repo, func(c *Config) {
+		c.SessionTTL = time.Hour
+		c.RememberTTL = 30 * 24 * time.Hour
+	})
+
+	for remember, ttl := range map[string]time.Duration{"": time.Hour, "on": 30 * 24 * time.Hour} {
+		resp := s.postForm(t, "/login", url.Values{"email": {"admin@example.com"}, "password": {"correct horse"}, "remember": {remember}}, nil)
+		cookie := sessionCookieOf(resp)
+		if cookie == nil {
+			t.Fatal("no session cookie")
+		}
+		if until := time.Until(cookie.Expires); until < ttl-time.Minute || until > ttl+time.Minute {
+			t.Errorf("remember=%q: cookie lasts %s, want %s", remember, until, ttl)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/integrity", nil)
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: s.h.signSession(admin.ID, time.Now().Add(-time.Second))})
+	expectStatus(t, s.do(t, req), fiber.StatusUnauthorized)
+}
+
+func TestLoginLockout(t *testing.T) {
+	repo := newTestRepository(t)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	setPassword(t, repo, admin, "correct horse")
+	s := newTestServer(t, repo, func(c *Config) {
+		c.LoginMaxFailures = 3
+		c.LoginLockout = time.Minute
+	})
+	login := func(password string) *http.Response {
+		return s.postForm(t, "/login", url.Values{"email": {"admin@example.com"}, "password": {password}}, nil)
+	}
+
+	expectStatus(t, login("wrong"), fiber.StatusUnauthorized)
+	expectStatus(t, login("correct horse"), fiber.StatusFound)
+	for range 2 {
+		expectStatus(t, login("wrong"), fiber.StatusUnauthorized)
+	}
+	// The success reset the count, so the lockout only starts after three more
+	expectStatus(t, login("wrong"), fiber.StatusUnauthorized)
+	resp := login("correct horse")
+	expectStatus(t, resp, fiber.StatusTooManyRequests)
+	if resp.Header.Get(fiber.HeaderRetryAfter) == "" {
+		t.Error("lockout has no Retry-After")
+	}
+
+	limiter := NewLoginLimiter(2, time.Minute)
+	now := time.Now()
+	limiter.Fail(now, "email:a")
+	limiter.Fail(now, "email:a")
+	if _, locked := limiter.Locked(now.Add(59*time.Second), "email:a"); !locked {
+		t.Error("not locked within the window")
+	}
+	if _, locked := limiter.Locked(now.Add(61*time.Second), "email:a"); locked {
+		t.Error("still locked after the window")
+	}
+}
+
+func TestBuildBooksWhere(t *testing.T) {
+	for _, tc := range []struct {
+		name, search, filter string
+		extra                []ListOption
+		clause               string
+		args                 []any
+	}{
+		{name: "neither", clause: " WHERE NOT archived"},
+		{name: "search", search: "go", clause: ` WHERE NOT archived AND title LIKE ? ESCAPE '\'`, args: []any{"%go%"}},
+		{name: "wildcards", search: `50%_\`, clause: ` WHERE NOT archived AND title LIKE ? ESCAPE '\'`, args: []any{`%50\%\_\\%`}},
+		{name: "injection", search: "'; DROP TABLE books; --", clause: ` WHERE NOT archived AND title LIKE ? ESCAPE '\'`, args: []any{"%'; DROP TABLE books; --%"}},
+		{name: "on sale", filter: "on_sale", clause: " WHERE NOT archived AND has_sales AND (sale_ends_at IS NULL OR sale_ends_at > ?)", args: []any{time.Time{}}},
+		{name: "not on sale", filter: "not_on_sale", clause: " WHERE NOT archived AND (NOT has_sales OR sale_ends_at <= ?)", args: []any{time.Time{}}},
+		{name: "archived", filter: "archived", clause: " WHERE archived"},
+		{name: "all", filter: "all", clause: " WHERE NOT archived"},
+		{name: "search and filter", search: "go", filter: "on_sale", clause: ` WHERE NOT archived AND title LIKE ? ESCAPE '\' AND has_sales AND (sale_ends_at IS NULL OR sale_ends_at > ?)`, args: []any{"%go%", time.Time{}}},
+		{name: "author", extra: []ListOption{WithAuthor("Le Guin")}, clause: " WHERE NOT archived AND author = ?", args: []any{"Le Guin"}},
+		{name: "author and language", extra: []ListOption{WithAuthor("Le Guin"), WithLanguage("en")}, clause: " WHERE NOT archived AND author = ? AND language = ?", args: []any{"Le Guin", "en"}},
+		{name: "everything", search: "go", filter: "not_on_sale", extra: []ListOption{WithAuthor("Pike")}, clause: ` WHERE NOT archived AND title LIKE ? ESCAPE '\' AND (NOT has_sales OR sale_ends_at <= ?) AND author = ?`, args: []any{"%go%", time.Time{}, "Pike"}},
+	} {
+		clause, args := buildBooksWhere(tc.search, tc.filter, tc.extra...)
+		if clause != tc.clause {
+			t.Errorf("%s: clause %q, want %q", tc.name, clause, tc.clause)
+		}
+		if len(args) != len(tc.args) {
+			t.Errorf("%s: args %v, want %v", tc.name, args, tc.args)
+			continue
+		}
+		for i, want := range tc.args {
+			// The current time can't be predicted, only its type
+			if _, isTime := want.(time.Time); isTime {
+				if _, ok := args[i].(time.Time); !ok {
+					t.Errorf("%s: arg %d is %v, want a time", tc.name, i, args[i])
+				}
+			} else if args[i] != want {
+				t.Errorf("%s: arg %d is %v, want %v", tc.name, i, args[i], want)
+			}
+		}
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewSQLiteRepository(db, false)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+
+	resp := s.get(t, "/admin/integrity", admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	var report IntegrityReport
+	decodeJSON(t, resp, &report)
+	if !report.OK || len(report.IntegrityErrors) != 0 || len(report.ForeignKeyViolations) != 0 {
+		t.Errorf("clean database reported %+v", report)
+	}
+
+	// Foreign keys are enforced per connection, so one pinned connection can
+	// store a book owned by an account that doesn't exist
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "INSERT INTO books (title, account_id) VALUES ('Orphan', 999)"); err != nil {
+		t.Fatal(err)
+	}
+	conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	conn.Close()
+
+	resp = s.get(t, "/admin/integrity", admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	report = IntegrityReport{}
+	decodeJSON(t, resp, &report)
+	if report.OK || len(report.ForeignKeyViolations) != 1 || report.ForeignKeyViolations[0].Table != "books" {
+		t.Errorf("orphaned book not reported: %+v", report)
+	}
+}
+
+func TestViewCountsAndPopularSort(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "Quiet", "Popular", "Middling")
+	s := newTestServer(t, repo, func(c *Config) { c.ViewFlushInterval = time.Hour })
+	ctx := context.Background()
+
+	for id, views := range map[int]int{books[1].ID: 3, books[2].ID: 1} {
+		for range views {
+			expectStatus(t, s.get(t, fmt.Sprintf("/books/%d", id), nil), fiber.StatusOK)
+		}
+	}
+	if err := s.h.views.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if book, _ := repo.GetBook(ctx, books[1].ID); book.Views != 3 {
+		t.Errorf("popular book has %d views, want 3", book.Views)
+	}
+
+	result, err := repo.ListBooks(ctx, 10, 0, "", "all", WithSort("popular"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(result.Books); !slices.Equal(got, []string{"Popular", "Middling", "Quiet"}) {
+		t.Errorf("popular order %q", got)
+	}
+
+	if err := repo.IncrementViews(ctx, books[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if book, _ := repo.GetBook(ctx, books[0].ID); book.Views != 1 {
+		t.Errorf("increment left %d views, want 1", book.Views)
+	}
+}
+
+// addViewsRecorder records each batch of views written
+type addViewsRecorder struct {
+	Repository
+	batches []map[int]int
+}
+
+func (r *addViewsRecorder) AddViews(ctx context.Context, deltas map[int]int) error {
+	r.batches = append(r.batches, deltas)
+	return r.Repository.AddViews(ctx, deltas)
+}
+
+func TestViewCounterBatches(t *testing.T) {
+	repo := &addViewsRecorder{Repository: newTestRepository(t)}
+	book := createBooks(t, repo, "Dune")[0]
+	lc := fxtest.NewLifecycle(t)
+	counter := NewViewCounter(lc, repo, zap.NewNop(), &Config{ViewFlushInterval: time.Hour})
+	lc.RequireStart()
+
+	for range 5 {
+		counter.Add(book.ID)
+	}
+	if len(repo.batches) != 0 {
+		t.Fatal("views were written before the flush")
+	}
+	// Stopping flushes what's left so no counts are lost
+	lc.RequireStop()
+
+	if len(repo.batches) != 1 || repo.batches[0][book.ID] != 5 {
+		t.Errorf("batches %v, want one of 5 views", repo.batches)
+	}
+	if stored, _ := repo.GetBook(context.Background(), book.ID); stored.Views != 5 {
+		t.Errorf("%d views stored, want 5", stored.Views)
+	}
+}
+
+// captureViews is a template engine that records what it's asked to render
+type captureViews struct {
+	binding fiber.Map
+}
+
+func (v *captureViews) Load() error { return nil }
+
+func (v *captureViews) Render(w io.Writer, name string, binding any, layouts ...string) error {
+	v.binding = binding.(fiber.Map)
+	return nil
+}
+
+func TestRenderMergesGlobals(t *testing.T) {
+	views := &captureViews{}
+	app := fiber.New(fiber.Config{Views: views})
+	admin := &Account{ID: 1, Name: "Ann Admin", Email: "ann@example.com", Role: RoleAdmin}
+	app.Get("/", func(c *fiber.Ctx) error {
+		c.Locals(siteLocal, SiteMeta{Title: "Shelf"})
+		c.Locals(accountLocal, admin)
+		return render(c, "books", fiber.Map{"Books": 3, "Page": "override"}, "books")
+	})
+	if _, err := app.Test(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if views.binding["Page"] != "override" || views.binding["Books"] != 3 {
+		t.Errorf("data wasn't kept: %v", views.binding)
+	}
+	if site, _ := views.binding["Site"].(SiteMeta); site.Title != "Shelf" {
+		t.Errorf("site %v", views.binding["Site"])
+	}
+	if account, _ := views.binding["CurrentAccount"].(AccountView); account.Name != admin.Name {
+		t.Errorf("current account %v", views.binding["CurrentAccount"])
+	}
+}
+
+func TestArchive(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "Kept", "Archived")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+	ctx := context.Background()
+	list := func(filter string) []string {
+		result, err := repo.ListBooks(ctx, 10, 0, "", filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bookTitles(result.Books)
+	}
+
+	expectStatus(t, s.postForm(t, fmt.Sprintf("/books/%d/archive", books[1].ID), nil, admin), fiber.StatusOK)
+	if got := list("all"); !slices.Equal(got, []string{"Kept"}) {
+		t.Errorf("default list %q", got)
+	}
+	if got := list("archived"); !slices.Equal(got, []string{"Archived"}) {
+		t.Errorf("archived list %q", got)
+	}
+
+	expectStatus(t, s.postForm(t, fmt.Sprintf("/books/%d/unarchive", books[1].ID), nil, admin), fiber.StatusOK)
+	if got := list("all"); !slices.Equal(got, []string{"Kept", "Archived"}) {
+		t.Errorf("list after restoring %q", got)
+	}
+	expectStatus(t, s.postForm(t, "/books/999/archive", nil, admin), fiber.StatusNotFound)
+}
+
+func TestOpenAPI(t *testing.T) {
+	s := newTestServer(t, newTestRepository(t))
+	resp := s.get(t, "/api/openapi.json", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	var doc struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	decodeJSON(t, resp, &doc)
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("openapi version %q", doc.OpenAPI)
+	}
+	for path, method := range map[string]string{
+		"/api/books":         "get",
+		"/api/books/changes": "get",
+		"/api/books/summary": "get",
+		"/api/books/batch":   "post",
+	} {
+		if _, ok := doc.Paths[path][method]; !ok {
+			t.Errorf("document doesn't describe %s %s", strings.ToUpper(method), path)
+		}
+	}
+}
+
+func TestCreateDuplicateTitle(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewSQLiteRepository(db, false)
+	createBooks(t, repo, "The Hobbit")
+	s := newTestServer(t, repo)
+
+	expectStatus(t, s.postForm(t, "/books/create", url.Values{"title": {"  THE HOBBIT "}}, nil), fiber.StatusConflict)
+	expectStatus(t, s.postForm(t, "/books/create", url.Values{"title": {"the hobbit"}, "force": {"true"}}, nil), fiber.StatusFound)
+	if count, _ := repo.CountBooks(context.Background()); count != 2 {
+		t.Errorf("%d books, want 2", count)
+	}
+
+	var id, parent, notUsed int
+	var detail string
+	err := db.QueryRow("EXPLAIN QUERY PLAN SELECT 1 FROM books WHERE lower(title) = lower(?)", "the hobbit").Scan(&id, &parent, &notUsed, &detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(detail, "idx_books_title_lower") {
+		t.Errorf("title lookup doesn't use the index: %s", detail)
+	}
+}
+
+func TestBulkUpsert(t *testing.T) {
+	repo := newTestRepository(t)
+	book := createBook(t, repo, &Book{Title: "Old title", Author: "Kept"})
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+
+	csvFile := fmt.Sprintf("id,title\n%d,New title\n,Brand new\nabc,Bad ID\n999,Missing\n", book.ID)
+	resp := s.postFile(t, "/books/bulk-upsert", "file", "books.csv", csvFile, admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	var summary BookUpsertSummary
+	decodeJSON(t, resp, &summary)
+	if summary.Created != 1 || summary.Updated != 1 || summary.Failed != 2 {
+		t.Errorf("summary %+v", summary)
+	}
+	if len(summary.Rows) == 4 && !strings.Contains(summary.Rows[2].Error, "not a valid book ID") {
+		t.Errorf("bad ID row error %q", summary.Rows[2].Error)
+	}
+
+	updated, err := repo.GetBook(context.Background(), book.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Title != "New title" || updated.Author != "Kept" {
+		t.Errorf("updated book %q by %q", updated.Title, updated.Author)
+	}
+	if count, _ := repo.CountBooks(context.Background()); count != 2 {
+		t.Errorf("%d books, want 2", count)
+	}
+}
+
+func TestMaxBulkIDs(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "A", "B", "C")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo, func(c *Config) { c.MaxBulkIDs = 3 })
+
+	within := url.Values{"action": {"add"}}
+	for _, book := range books {
+		within.Add("book_ids", strconv.Itoa(book.ID))
+	}
+	over := url.Values{"action": {"add"}}
+	for i := range 10000 {
+		over.Add("book_ids", strconv.Itoa(i+1))
+	}
+	for _, path := range []string{"/books/bulk-update-sales", "/books/delete"} {
+		resp := s.postForm(t, path, over, admin)
+		expectStatus(t, resp, fiber.StatusBadRequest)
+		if body := readBody(t, resp); body != "Too many books selected; the limit is 3." {
+			t.Errorf("%s: %q", path, body)
+		}
+		if resp := s.postForm(t, path, within, admin); resp.StatusCode >= fiber.StatusBadRequest {
+			t.Errorf("%s: a request at the limit got %d", path, resp.StatusCode)
+		}
+	}
+
+	ids := []int{books[0].ID, books[1].ID, books[2].ID, 999}
+	expectStatus(t, s.postJSON(t, "/books/reorder", fiber.Map{"ids": ids}, admin), fiber.StatusBadRequest)
+}
+
+func TestRandomBook(t *testing.T) {
+	repo := newTestRepository(t)
+	s := newTestServer(t, repo)
+	expectStatus(t, s.get(t, "/books/random", nil), fiber.StatusNotFound)
+
+	books := createBooks(t, repo, "A", "B")
+	resp := s.get(t, "/books/random", nil)
+	expectStatus(t, resp, fiber.StatusFound)
+	location := resp.Header.Get(fiber.HeaderLocation)
+	if location != fmt.Sprintf("/books/%d", books[0].ID) && location != fmt.Sprintf("/books/%d", books[1].ID) {
+		t.Errorf("redirected to %q", location)
+	}
+}
+
+func TestResetDemoData(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "Not a sample")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+	reset := func(account *Account) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reset", nil)
+		req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+		s.signIn(req, account)
+		return s.do(t, req)
+	}
+
+	resp := reset(admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	var result struct {
+		Books, Accounts int
+		Notice          string
+	}
+	decodeJSON(t, resp, &result)
+	if result.Books != len(sampleBooks) || result.Accounts != len(sampleAccounts) {
+		t.Errorf("reset to %+v, want %d books and %d accounts", result, len(sampleBooks), len(sampleAccounts))
+	}
+	if !strings.Contains(result.Notice, "signed out") {
+		t.Errorf("notice %q doesn't say sessions ended", result.Notice)
+	}
+
+	// The admin's account is gone, and its ID isn't handed to a sample account
+	expectStatus(t, reset(admin), fiber.StatusUnauthorized)
+
+	accounts, err := repo.ListAccounts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, account := range accounts {
+		if account.ID == admin.ID {
+			t.Fatalf("sample account %q reuses the deleted admin's ID", account.Name)
+		}
+		if account.IsAdmin() {
+			expectStatus(t, reset(account), fiber.StatusOK)
+		}
+	}
+
+	user := createAccount(t, repo, "User", RoleUser)
+	expectStatus(t, s.postForm(t, "/admin/reset", nil, user), fiber.StatusForbidden)
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	s := newTestServer(t, newTestRepository(t), func(c *Config) { c.RedirectTrailingSlash = true })
+
+	for path, want := range map[string]string{
+		"/books/":             "/books",
+		"/books/?search=go":   "/books?search=go",
+		"//evil.example.com/": "/evil.example.com",
+	} {
+		resp := s.get(t, path, nil)
+		expectStatus(t, resp, fiber.StatusMovedPermanently)
+		if got := resp.Header.Get(fiber.HeaderLocation); got != want {
+			t.Errorf("%s redirected to %q, want %q", path, got, want)
+		}
+	}
+	expectStatus(t, s.postForm(t, "/books/create/", url.Values{"title": {"x"}}, nil), fiber.StatusPermanentRedirect)
+	expectStatus(t, s.get(t, "/books", nil), fiber.StatusOK)
+}
+
+func TestBookNotes(t *testing.T) {
+	repo := newTestRepository(t)
+	book := createBooks(t, repo, "Dune")[0]
+	s := newTestServer(t, repo)
+	path := fmt.Sprintf("/books/%d", book.ID)
+	notes := func() string {
+		stored, err := repo.GetBook(context.Background(), book.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored.Notes
+	}
+
+	expectStatus(t, s.postForm(t, path, url.Values{"title": {"Dune"}, "notes": {"Reread the appendices"}}, nil), fiber.StatusFound)
+	if got := notes(); got != "Reread the appendices" {
+		t.Errorf("notes %q", got)
+	}
+	if body := readBody(t, s.get(t, path, nil)); !strings.Contains(body, "Reread the appendices") {
+		t.Error("detail page doesn't show the notes")
+	}
+
+	expectStatus(t, s.postForm(t, path, url.Values{"title": {"Dune"}, "notes": {strings.Repeat("é", maxNotesLength+1)}}, nil), fiber.StatusBadRequest)
+	if errs := validateBook(&Book{Title: "Dune", Notes: strings.Repeat("é", maxNotesLength)}); errs != nil {
+		t.Errorf("notes at the limit rejected: %v", errs)
+	}
+
+	expectStatus(t, s.postForm(t, path, url.Values{"title": {"Dune"}, "notes": {""}}, nil), fiber.StatusFound)
+	if got := notes(); got != "" {
+		t.Errorf("notes %q after clearing", got)
+	}
+}
+
+func TestParamID(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "Dune")
+	createAccount(t, repo, "Ann", RoleUser)
+	s := newTestServer(t, repo)
+
+	for _, base := range []string{"/books/", "/accounts/"} {
+		expectStatus(t, s.get(t, base+"1", nil), fiber.StatusOK)
+		for _, id := range []string{"0", "-1", "abc", "1.5"} {
+			resp := s.get(t, base+id, nil)
+			expectStatus(t, resp, fiber.StatusBadRequest)
+			if body := readBody(t, resp); body != "Invalid id: must be a positive integer" {
+				t.Errorf("%s%s: %q", base, id, body)
+			}
+		}
+	}
+	expectStatus(t, s.postForm(t, "/books/abc", url.Values{"title": {"x"}}, nil), fiber.StatusBadRequest)
+}
+
+func TestReassignBooks(t *testing.T) {
+	repo := newTestRepository(t)
+	from := createAccount(t, repo, "From", RoleUser)
+	to := createAccount(t, repo, "To", RoleUser)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	for _, title := range []string{"A", "B"} {
+		createBook(t, repo, &Book{Title: title, AccountID: &from.ID})
+	}
+	s := newTestServer(t, repo)
+	ctx := context.Background()
+	reassign := func(source *Account, target int) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/accounts/%d/reassign", source.ID), strings.NewReader(url.Values{"to": {strconv.Itoa(target)}}.Encode()))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+		s.signIn(req, admin)
+		return s.do(t, req)
+	}
+	moved := func(resp *http.Response) int64 {
+		expectStatus(t, resp, fiber.StatusOK)
+		var body struct {
+			Moved int64 `json:"moved"`
+		}
+		decodeJSON(t, resp, &body)
+		return body.Moved
+	}
+
+	if n := moved(reassign(from, to.ID)); n != 2 {
+		t.Errorf("moved %d books, want 2", n)
+	}
+	if count, _ := repo.CountBooksByAccount(ctx, to.ID); count != 2 {
+		t.Errorf("target owns %d books, want 2", count)
+	}
+	if n := moved(reassign(from, to.ID)); n != 0 {
+		t.Errorf("moving from an account without books moved %d", n)
+	}
+	expectStatus(t, reassign(from, from.ID), fiber.StatusBadRequest)
+	expectStatus(t, reassign(from, 999), fiber.StatusNotFound)
+}
+
+func TestTimeago(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	for offset, want := range map[time.Duration]string{
+		-3 * time.Second:      "just now",
+		-45 * time.Second:     "45 seconds ago",
+		-time.Minute:          "1 minute ago",
+		-5 * time.Minute:      "5 minutes ago",
+		-2 * time.Hour:        "2 hours ago",
+		-3 * 24 * time.Hour:   "3 days ago",
+		2 * time.Hour:         "in 2 hours",
+		24*time.Hour + 1:      "in 1 day",
+		30 * time.Second:      "in 30 seconds",
+		-400 * 24 * time.Hour: "400 days ago",
+	} {
+		if got := timeagoAt(now.Add(offset), now); got != want {
+			t.Errorf("timeagoAt(now%+v) = %q, want %q", offset, got, want)
+		}
+	}
+	if got := timeagoAt(time.Time{}, now); got != "" {
+		t.Errorf("zero time rendered as %q", got)
+	}
+}
+
+func TestAPIBookBatch(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "Update me", "Delete me")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+	ctx := context.Background()
+
+	resp := s.postJSON(t, "/api/books/batch", BookBatch{
+		Create: []*Book{{Title: "Created"}},
+		Update: []*Book{{ID: books[0].ID, Title: "Updated"}},
+		Delete: []int{books[1].ID},
+	}, admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	var result BookBatchResult
+	decodeJSON(t, resp, &result)
+	if len(result.Created) != 1 || !slices.Equal(result.Updated, []int{books[0].ID}) || !slices.Equal(result.Deleted, []int{books[1].ID}) || result.RolledBack {
+		t.Errorf("result %+v", result)
+	}
+	all, _ := repo.ListBooks(ctx, 10, 0, "", "all")
+	if got := bookTitles(all.Books); !slices.Equal(got, []string{"Updated", "Created"}) {
+		t.Errorf("books after the batch %q", got)
+	}
+
+	resp = s.postJSON(t, "/api/books/batch", BookBatch{
+		Create: []*Book{{Title: "Rolled back"}},
+		Update: []*Book{{ID: 999, Title: "Missing"}},
+	}, admin)
+	expectStatus(t, resp, fiber.StatusUnprocessableEntity)
+	result = BookBatchResult{}
+	decodeJSON(t, resp, &result)
+	if !result.RolledBack || len(result.Failed) != 1 || result.Failed[0].ID != 999 || len(result.Created) != 0 {
+		t.Errorf("rejected batch %+v", result)
+	}
+	if count, _ := repo.CountBooks(ctx); count != 2 {
+		t.Errorf("%d books after a rolled back batch, want 2", count)
+	}
+}
+
+func TestHomeRedirect(t *testing.T) {
+	repo := newTestRepository(t)
+	resp := newTestServer(t, repo, func(c *Config) { c.HomeRedirect = "/books" }).get(t, "/", nil)
+	expectStatus(t, resp, fiber.StatusFound)
+	if got := resp.Header.Get(fiber.HeaderLocation); got != "/books" {
+		t.Errorf("redirected to %q", got)
+	}
+
+	resp = newTestServer(t, repo).get(t, "/", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	if !strings.Contains(readBody(t, resp), "Welcome to Book & Account Manager") {
+		t.Error("home page wasn't rendered")
+	}
+
+	cfg := newTestConfig(t)
+	cfg.HomeRedirect = "https://example.com/"
+	if err := cfg.Validate(); err == nil {
+		t.Error("an off-site home redirect was accepted")
+	}
+}
+
+func TestGetAdjacentBooks(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "C", "A", "B")
+	ctx := context.Background()
+
+	prev, next, err := repo.GetAdjacentBooks(ctx, books[1].ID, "manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev == nil || prev.Title != "C" || next == nil || next.Title != "B" {
+		t.Errorf("neighbors of A in manual order: %v, %v", prev, next)
+	}
+	prev, next, err = repo.GetAdjacentBooks(ctx, books[1].ID, "title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev != nil || next == nil || next.Title != "B" {
+		t.Errorf("neighbors of the first book by title: %v, %v", prev, next)
+	}
+	prev, next, err = repo.GetAdjacentBooks(ctx, books[2].ID, "manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev == nil || prev.Title != "A" || next != nil {
+		t.Errorf("neighbors of the last book: %v, %v", prev, next)
+	}
+	if _, _, err := repo.GetAdjacentBooks(ctx, 999, "manual"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("unknown book: %v", err)
+	}
+
+	s := newTestServer(t, repo)
+	body := readBody(t, s.get(t, fmt.Sprintf("/books/%d", books[1].ID), nil))
+	if !strings.Contains(body, fmt.Sprintf(`href="/books/%d?sort=manual"`, books[0].ID)) || !strings.Contains(body, fmt.Sprintf(`href="/books/%d?sort=manual"`, books[2].ID)) {
+		t.Error("detail page doesn't link both neighbors")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "A", "B", "C")
+	s := newTestServer(t, repo)
+
+	req := httptest.NewRequest(http.MethodGet, "/books", nil)
+	req.Header.Set(fiber.HeaderAcceptEncoding, "gzip")
+	resp := s.do(t, req)
+	expectStatus(t, resp, fiber.StatusOK)
+	if got := resp.Header.Get(fiber.HeaderContentEncoding); got != "gzip" {
+		t.Errorf("Content-Encoding %q, want gzip", got)
+	}
+
+	resp = s.get(t, "/books", nil)
+	if got := resp.Header.Get(fiber.HeaderContentEncoding); got != "" {
+		t.Errorf("uncompressed request got Content-Encoding %q", got)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	repo := newTestRepository(t)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/accounts/%d/tokens", admin.ID), strings.NewReader("name=script"))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	s.signIn(req, admin)
+	resp := s.do(t, req)
+	expectStatus(t, resp, fiber.StatusCreated)
+	var minted struct {
+		Token    string   `json:"token"`
+		APIToken APIToken `json:"api_token"`
+	}
+	decodeJSON(t, resp, &minted)
+
+	withToken := func(token string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/api/books/batch", strings.NewReader(`{"create":[{"title":"Scripted"}]}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		return s.do(t, req)
+	}
+	expectStatus(t, withToken(minted.Token), fiber.StatusOK)
+	expectStatus(t, withToken("not-a-token"), fiber.StatusUnauthorized)
+
+	if err := repo.RevokeAPIToken(context.Background(), admin.ID, minted.APIToken.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, withToken(minted.Token), fiber.StatusUnauthorized)
+}
+
+func TestDeleteAccountMovesBooksToOrphanAccount(t *testing.T) {
+	repo := newTestRepository(t)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	leaving := createAccount(t, repo, "Leaving", RoleUser)
+	book := createBook(t, repo, &Book{Title: "Left behind", AccountID: &leaving.ID})
+	s := newTestServer(t, repo, func(c *Config) { c.OrphanAccountID = 100 })
+	ctx := context.Background()
+
+	expectStatus(t, s.postForm(t, fmt.Sprintf("/accounts/%d/delete", leaving.ID), nil, admin), fiber.StatusFound)
+	moved, err := repo.GetBook(ctx, book.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.AccountID == nil || *moved.AccountID != 100 {
+		t.Errorf("book owned by %v, want the orphan account 100", moved.AccountID)
+	}
+	if _, err := repo.GetAccount(ctx, 100); err != nil {
+		t.Errorf("orphan account wasn't created: %v", err)
+	}
+	if result, _ := repo.ListBooks(ctx, 10, 0, "", "all"); len(result.Books) != 1 {
+		t.Error("the moved book isn't listed")
+	}
+}
+
+func TestGlobalSearch(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "Ursula's Tales", "Dune")
+	repo.CreateAccount(context.Background(), &Account{Name: "Ursula", Email: "ul@example.com"})
+	s := newTestServer(t, repo)
+
+	body := readBody(t, s.get(t, "/search?q=ursula", nil))
+	if !strings.Contains(body, "Ursula&#39;s Tales") || !strings.Contains(body, "ul@example.com") || strings.Contains(body, "Dune") {
+		t.Errorf("search results: %s", body)
+	}
+}
+
+func TestGlobalSearchPaging(t *testing.T) {
+	repo := newTestRepository(t)
+	ctx := context.Background()
+	for i := range searchGroupLimit + 2 {
+		createBook(t, repo, &Book{Title: fmt.Sprintf("Match book %02d", i)})
+		if _, err := repo.CreateAccount(ctx, &Account{Name: fmt.Sprintf("Match person %02d", i), Email: fmt.Sprintf("p%02d@example.com", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer(t, repo)
+	last := fmt.Sprintf("%02d", searchGroupLimit+1)
+
+	body := readBody(t, s.get(t, "/search?q=match&books_page=2", nil))
+	if !strings.Contains(body, "Match book "+last) || strings.Contains(body, "Match book 00") {
+		t.Error("books_page=2 didn't page the books")
+	}
+	if !strings.Contains(body, "Match person 00") || strings.Contains(body, "Match person "+last) {
+		t.Error("books_page=2 moved the accounts too")
+	}
+
+	body = readBody(t, s.get(t, "/search?q=match&accounts_page=2", nil))
+	if !strings.Contains(body, "Match person "+last) || !strings.Contains(body, "Match book 00") {
+		t.Error("accounts_page=2 didn't page only the accounts")
+	}
+}
+
+// testRepositoryReads checks the read methods every repository implements
+// against a catalog seeded with seed, which inserts a book row
+func testRepositoryReads(t *testing.T, repo Repository, seed func(title, author string)) {
+	ctx := context.Background()
+	seed("Emma", "Jane Austen")
+	seed("Dracula", "Bram Stoker")
+	seed("Persuasion", "Jane Austen")
+
+	if count, err := repo.CountBooks(ctx); err != nil || count != 3 {
+		t.Errorf("CountBooks = %d, %v", count, err)
+	}
+	result, err := repo.ListBooks(ctx, 2, 0, "", "all", WithSort("title"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(result.Books); !slices.Equal(got, []string{"Dracula", "Emma"}) || result.TotalCount != 3 {
+		t.Errorf("ListBooks page %q of %d", got, result.TotalCount)
+	}
+	result, err = repo.ListBooks(ctx, 10, 0, "sua", "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(result.Books); !slices.Equal(got, []string{"Persuasion"}) {
+		t.Errorf("search found %q", got)
+	}
+	authors, err := repo.ListAuthors(ctx)
+	if err != nil || !slices.Equal(authors, []string{"Bram Stoker", "Jane Austen"}) {
+		t.Errorf("ListAuthors = %q, %v", authors, err)
+	}
+	book, err := repo.GetBook(ctx, result.Books[0].ID)
+	if err != nil || book.Author != "Jane Austen" {
+		t.Errorf("GetBook = %v, %v", book, err)
+	}
+	if _, err := repo.GetBook(ctx, 999); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetBook of a missing book: %v", err)
+	}
+}
+
+func TestSQLiteRepositoryReads(t *testing.T) {
+	db := newTestDB(t)
+	testRepositoryReads(t, NewSQLiteRepository(db, false), func(title, author string) {
+		if _, err := db.Exec("INSERT INTO books (title, author, created_at, updated_at) VALUES (?, ?, ?, ?)", title, author, time.Now().UTC(), time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestReadOnlyRouter checks that with a PostgreSQL database only the read
+// routes are registered, so writes fail fast instead of reaching the
+// repository
+func TestReadOnlyRouter(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "Dune")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	cfg := newTestConfig(t)
+	app, err := NewFiber(cfg)
+	if err != nil {
+		t.Fatalf("fiber: %v", err)
+	}
+	logger := zap.NewNop()
+	h := NewHandler(repo, logger, cfg, NewViewCounter(fxtest.NewLifecycle(t), repo, logger, cfg))
+	h.RegisterRoutes(readOnlyRouter{app})
+	s := &testServer{app: app, h: h, repo: repo, cfg: cfg}
+
+	id := strconv.Itoa(books[0].ID)
+	expectStatus(t, s.get(t, "/books/"+id, admin), fiber.StatusOK)
+	expectStatus(t, s.get(t, "/api/books", admin), fiber.StatusOK)
+	for _, path := range []string{"/books", "/books/" + id, "/books/delete", "/api/books/batch"} {
+		resp := s.postForm(t, path, url.Values{"title": {"Changed"}}, admin)
+		if resp.StatusCode != fiber.StatusNotFound && resp.StatusCode != fiber.StatusMethodNotAllowed {
+			t.Errorf("POST %s = %d, want 404 or 405", path, resp.StatusCode)
+		}
+	}
+	if book, _ := repo.GetBook(context.Background(), books[0].ID); book.Title != "Dune" {
+		t.Errorf("title changed to %q", book.Title)
+	}
+}
+
+func TestDialect(t *testing.T) {
+	if got := sqliteDialect.In(3); got != "?,?,?" {
+		t.Errorf("sqlite In(3) = %q", got)
+	}
+	if got := postgresDialect.In(3); got != "$1,$2,$3" {
+		t.Errorf("postgres In(3) = %q", got)
+	}
+	if got := postgresDialect.Placeholder(7); got != "$7" {
+		t.Errorf("postgres Placeholder(7) = %q", got)
+	}
+	query := "SELECT * FROM books WHERE title = ? AND id > ?"
+	if got := sqliteDialect.Rebind(query); got != query {
+		t.Errorf("sqlite Rebind changed the query: %q", got)
+	}
+	if got := postgresDialect.Rebind(query); got != "SELECT * FROM books WHERE title = $1 AND id > $2" {
+		t.Errorf("postgres Rebind = %q", got)
+	}
+}
+
+func TestCatalogStats(t *testing.T) {
+	repo := newTestRepository(t)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	for _, book := range []*Book{
+		{Title: "Abcd", Author: "One", HasSales: true},
+		{Title: "Ab", Author: "Two"},
+		{Title: "Abcdef", Author: "One"},
+	} {
+		createBook(t, repo, book)
+	}
+	s := newTestServer(t, repo)
+
+	resp := s.get(t, "/admin/stats", admin)
+	expectStatus(t, resp, fiber.StatusOK)
+	var stats CatalogStats
+	decodeJSON(t, resp, &stats)
+	if stats.TotalBooks != 3 || stats.OnSale != 1 || stats.DistinctAuthors != 2 || stats.AverageTitleLength != 4 {
+		t.Errorf("stats %+v", stats)
+	}
+	if stats.OldestCreatedAt == nil || stats.NewestCreatedAt == nil || stats.NewestCreatedAt.Before(*stats.OldestCreatedAt) {
+		t.Errorf("created_at bounds %v, %v", stats.OldestCreatedAt, stats.NewestCreatedAt)
+	}
+
+	empty, err := newTestRepository(t).CatalogStats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.TotalBooks != 0 || empty.OldestCreatedAt != nil {
+		t.Errorf("empty catalog stats %+v", empty)
+	}
+}
+
+func TestSanitizeNotes(t *testing.T) {
+	for notes, want := range map[string]string{
+		"<b>bold</b> and <em>em</em>":              "<b>bold</b> and <em>em</em>",
+		"<script>alert(1)</script>safe":            "safe",
+		`<p onclick="steal()">text</p>`:            "<p>text</p>",
+		`<a href="javascript:x">link</a>`:          "link",
+		"<b>unclosed":                              "<b>unclosed</b>",
+		"1 < 2 & 3":                                "1 &lt; 2 &amp; 3",
+		"<STYLE>body{}</STYLE><I>kept</I>":         "<i>kept</i>",
+		"<img src=x onerror=alert(1)>line<br>next": "line<br>next",
+		"<ul><li>one<li>two</ul>":                  "<ul><li>one<li>two</li></li></ul>",
+	} {
+		if got := string(sanitizeNotes(notes)); got != want {
+			t.Errorf("sanitizeNotes(%q) = %q, want %q", notes, got, want)
+		}
+	}
+	if got := notesRenderer(false)("<b>bold</b>"); got != "&lt;b&gt;bold&lt;/b&gt;" {
+		t.Errorf("plain notes rendered as %q", got)
+	}
+}
+
+// writeImportFiles creates an empty .txt file for each title in dir
+func writeImportFiles(t *testing.T, dir string, titles ...string) {
+	t.Helper()
+	for _, title := range titles {
+		if err := os.WriteFile(filepath.Join(dir, title+".txt"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImportMaxFiles(t *testing.T) {
+	repo := newTestRepository(t)
+	s := newTestServer(t, repo, func(c *Config) { c.ImportMaxFiles = 10 })
+	dir := t.TempDir()
+	for i := range 25 {
+		writeImportFiles(t, dir, fmt.Sprintf("Book %02d", i))
+	}
+
+	stats, err := s.h.importBooksFromDir(context.Background(), dir, func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Seen != 25 || stats.Imported != 10 || stats.Remaining != 15 {
+		t.Errorf("stats %+v, want 10 imported and 15 remaining", stats)
+	}
+	if count, _ := repo.CountBooks(context.Background()); count != 10 {
+		t.Errorf("%d books, want 10", count)
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if len(left) != 15 {
+		t.Errorf("%d files left, want 15", len(left))
+	}
+}
+
+func TestBookLanguage(t *testing.T) {
+	repo := newTestRepository(t)
+	s := newTestServer(t, repo)
+	ctx := context.Background()
+
+	expectStatus(t, s.postForm(t, "/books/create", url.Values{"title": {"Cien años"}, "language": {"ES"}}, nil), fiber.StatusFound)
+	expectStatus(t, s.postForm(t, "/books/create", url.Values{"title": {"Klingon"}, "language": {"tlh"}}, nil), fiber.StatusBadRequest)
+	createBook(t, repo, &Book{Title: "Emma", Language: "en"})
+
+	result, err := repo.ListBooks(ctx, 10, 0, "", "all", WithLanguage("es"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(result.Books); !slices.Equal(got, []string{"Cien años"}) || result.Books[0].Language != "es" {
+		t.Errorf("spanish books %q", got)
+	}
+	if body := readBody(t, s.get(t, "/books?language=en", nil)); !strings.Contains(body, "Emma") || strings.Contains(body, "Cien años") {
+		t.Error("the language filter doesn't narrow the list")
+	}
+}
+
+func TestFirstRunHome(t *testing.T) {
+	repo := newTestRepository(t)
+	s := newTestServer(t, repo)
+	guide := readBody(t, s.get(t, "/", nil))
+
+	createBooks(t, repo, "Dune")
+	normal := readBody(t, s.get(t, "/", nil))
+	if !strings.Contains(guide, `href="/books/create"`) || strings.Contains(normal, `href="/books/create"`) {
+		t.Error("the first-run guide isn't shown only for an empty catalog")
+	}
+}
+
+func TestExpireSales(t *testing.T) {
+	repo := newTestRepository(t)
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	ended := createBook(t, repo, &Book{Title: "Ended", HasSales: true, SaleEndsAt: &past})
+	running := createBook(t, repo, &Book{Title: "Running", HasSales: true, SaleEndsAt: &future})
+	open := createBook(t, repo, &Book{Title: "Open-ended", HasSales: true})
+	ctx := context.Background()
+
+	logger, logs := observedLogger(zapcore.InfoLevel)
+	expirer := NewSaleExpirer(fxtest.NewLifecycle(t), repo, logger, &Config{})
+	expirer.run(ctx, time.Now())
+
+	for book, want := range map[*Book]bool{ended: false, running: true, open: true} {
+		stored, err := repo.GetBook(ctx, book.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.HasSales != want {
+			t.Errorf("%s: has_sales %v, want %v", book.Title, stored.HasSales, want)
+		}
+	}
+	if logs.Len() != 1 || logs.All()[0].ContextMap()["books"] != int64(1) {
+		t.Errorf("logs %v", logs.All())
+	}
+}
+
+func TestWindowedListBooksMatches(t *testing.T) {
+	db := newTestDB(t)
+	twoQueries, windowed := NewSQLiteRepository(db, false), NewSQLiteRepository(db, true)
+	for i := range 7 {
+		createBook(t, twoQueries, &Book{Title: fmt.Sprintf("Book %d", i), HasSales: i%2 == 0})
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		limit, offset  int
+		search, filter string
+	}{
+		{3, 0, "", "all"}, {3, 6, "", "all"}, {3, 9, "", "all"}, {5, 0, "Book 1", "all"}, {2, 2, "", "on_sale"}, {5, 0, "none", "all"},
+	} {
+		want, err := twoQueries.ListBooks(ctx, tc.limit, tc.offset, tc.search, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := windowed.ListBooks(ctx, tc.limit, tc.offset, tc.search, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v: windowed %+v, two queries %+v", tc, got, want)
+		}
+	}
+}
+
+func TestBulkEditValidation(t *testing.T) {
+	repo := newTestRepository(t)
+	books := createBooks(t, repo, "A", "B", "C")
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+	selection := []string{strconv.Itoa(books[0].ID), strconv.Itoa(books[1].ID)}
+
+	resp := s.postForm(t, "/books/bulk-edit", url.Values{"book_ids": selection, "books[abc][title]": {"X"}}, admin)
+	expectStatus(t, resp, fiber.StatusBadRequest)
+	if body := readBody(t, resp); !strings.Contains(body, `book ID "abc" is not a positive integer`) {
+		t.Errorf("malformed key: %s", body)
+	}
+
+	outside := fmt.Sprintf("books[%d][title]", books[2].ID)
+	resp = s.postForm(t, "/books/bulk-edit", url.Values{"book_ids": selection, outside: {"X"}}, admin)
+	expectStatus(t, resp, fiber.StatusBadRequest)
+	if body := readBody(t, resp); !strings.Contains(body, fmt.Sprintf("book %d is not in the selection", books[2].ID)) {
+		t.Errorf("book outside the selection: %s", body)
+	}
+	if book, _ := repo.GetBook(context.Background(), books[2].ID); book.Title != "C" {
+		t.Error("a rejected edit changed a book")
+	}
+}
+
+func TestCreateRedirect(t *testing.T) {
+	repo := newTestRepository(t)
+	s := newTestServer(t, repo)
+
+	resp := s.postForm(t, "/books/create", url.Values{"title": {"Listed"}}, nil)
+	expectStatus(t, resp, fiber.StatusFound)
+	if got := resp.Header.Get(fiber.HeaderLocation); got != "/books" {
+		t.Errorf("default redirect %q", got)
+	}
+
+	resp = s.postForm(t, "/books/create", url.Values{"title": {"Detailed"}, "redirect": {"detail"}}, nil)
+	expectStatus(t, resp, fiber.StatusFound)
+	result, _ := repo.ListBooks(context.Background(), 10, 0, "Detailed", "all")
+	if got := resp.Header.Get(fiber.HeaderLocation); len(result.Books) != 1 || got != fmt.Sprintf("/books/%d", result.Books[0].ID) {
+		t.Errorf("detail redirect %q", got)
+	}
+	expectStatus(t, s.postForm(t, "/books/create", url.Values{"title": {"Nowhere"}, "redirect": {"home"}}, nil), fiber.StatusBadRequest)
+}
+
+func TestNewBookView(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	for _, tc := range []struct {
+		book   Book
+		status string
+		onSale bool
+	}{
+		{Book{Title: "Plain"}, "Not on sale", false},
+		{Book{Title: "Sale", HasSales: true}, "On sale", true},
+		{Book{Title: "Running", HasSales: true, SaleEndsAt: &future}, "On sale", true},
+		{Book{Title: "Ended", HasSales: true, SaleEndsAt: &past}, "Sale ended", false},
+		{Book{Title: "Archived", HasSales: true, Archived: true}, "Archived", true},
+	} {
+		view := newBookView(&tc.book, now)
+		if view.Status != tc.status || view.OnSale != tc.onSale {
+			t.Errorf("%s: status %q on sale %v, want %q %v", tc.book.Title, view.Status, view.OnSale, tc.status, tc.onSale)
+		}
+	}
+	view := newBookView(&Book{Language: "fr", SaleEndsAt: &future}, now)
+	if view.LanguageName != "French" || view.SaleEndsLabel != "2024-05-10 13:00 UTC" {
+		t.Errorf("labels %q, %q", view.LanguageName, view.SaleEndsLabel)
+	}
+
+	account := newAccountView(&Account{Name: "Ann Lee", Email: "ann@example.com", Role: RoleAdmin})
+	if account.Initials != "AL" || account.AvatarColor != avatarColor("ann@example.com") {
+		t.Errorf("account view %+v", account)
+	}
+}
+
+func TestSetBookTags(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewSQLiteRepository(db, false)
+	books := createBooks(t, repo, "A", "B", "C")
+	ctx := context.Background()
+	tagsOf := func(id int) []string {
+		rows, err := db.Query("SELECT t.name FROM tags t JOIN book_tags bt ON bt.tag_id = t.id WHERE bt.book_id = ? ORDER BY t.name", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var tags []string
+		for rows.Next() {
+			var tag string
+			rows.Scan(&tag)
+			tags = append(tags, tag)
+		}
+		return tags
+	}
+
+	if err := repo.SetBookTags(ctx, []int{books[0].ID, books[1].ID, books[2].ID}, []string{"old"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo)
+	form := url.Values{"book_ids": {strconv.Itoa(books[0].ID), strconv.Itoa(books[1].ID)}, "tags": {"Sci-Fi, classic, classic"}}
+	expectStatus(t, s.postForm(t, "/books/bulk-set-tags", form, admin), fiber.StatusFound)
+
+	for i, want := range [][]string{{"classic", "sci-fi"}, {"classic", "sci-fi"}, {"old"}} {
+		if got := tagsOf(books[i].ID); !slices.Equal(got, want) {
+			t.Errorf("book %d tags %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestImportStats(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "Existing")
+	s := newTestServer(t, repo)
+	dir := t.TempDir()
+	writeImportFiles(t, dir, "New one", "New two", "Existing")
+	// A directory in processed with a file's name makes moving that file fail
+	if err := os.MkdirAll(filepath.Join(dir, "processed", "Blocked.txt", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeImportFiles(t, dir, "Blocked")
+	os.WriteFile(filepath.Join(dir, "notes.md"), nil, 0o644)
+
+	stats, err := s.h.importBooksFromDir(context.Background(), dir, func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocked's book is saved before its move fails, so it counts as imported
+	if stats.Seen != 4 || stats.Imported != 3 || stats.Skipped != 1 || stats.Failed != 0 || stats.Batches != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+	if summary := stats.Summary(); !strings.HasPrefix(summary, "Imported 3 new books from 4 files, skipped 1 already in the catalog") {
+		t.Errorf("summary %q", summary)
+	}
+}
+
+func TestListIncompleteBooks(t *testing.T) {
+	repo := newTestRepository(t)
+	for _, book := range []*Book{
+		{Title: "Complete", Author: "Someone"},
+		{Title: "No author"},
+		{Title: "Blank author", Author: "   "},
+		{Title: "Archived"},
+	} {
+		createBook(t, repo, book)
+	}
+	ctx := context.Background()
+	if err := repo.SetArchived(ctx, 4, true); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := repo.ListIncompleteBooks(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(result.Books); !slices.Equal(got, []string{"No author", "Blank author"}) || result.TotalCount != 2 {
+		t.Errorf("incomplete books %q (total %d)", got, result.TotalCount)
+	}
+	s := newTestServer(t, repo)
+	body := readBody(t, s.get(t, "/books/incomplete", nil))
+	if !strings.Contains(body, "No author") || strings.Contains(body, "Complete") {
+		t.Error("incomplete page lists the wrong books")
+	}
+}
+
+func TestStreamBooks(t *testing.T) {
+	repo := newTestRepository(t)
+	createBooks(t, repo, "Go in Action", "Dune", "Learning Go", "Emma")
+	ctx := context.Background()
+
+	var streamed []string
+	err := repo.StreamBooks(ctx, "go", "all", func(book *Book) error {
+		streamed = append(streamed, book.Title)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(streamed, []string{"Go in Action", "Learning Go"}) {
+		t.Errorf("streamed %q", streamed)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = repo.StreamBooks(ctx, "", "all", func(*Book) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("StreamBooks returned %v after %d calls, want the callback's error after 1", err, calls)
+	}
+}
+
+// streamOnlyRepository fails the test if the export lists books rather than
+// streaming them, and can make streaming fail after the first book
+type streamOnlyRepository struct {
+	Repository
+	t       *testing.T
+	failErr error
+}
+
+func (r *streamOnlyRepository) ListBooks(ctx context.Context, limit, offset int, search, filter string, opts ...ListOption) (*PaginatedBooks, error) {
+	r.t.Errorf("export called ListBooks(limit %d)", limit)
+	return r.Repository.ListBooks(ctx, limit, offset, search, filter, opts...)
+}
+
+func (r *streamOnlyRepository) StreamBooks(ctx context.Context, search, filter string, fn func(*Book) error, opts ...ListOption) error {
+	first := true
+	return r.Repository.StreamBooks(ctx, search, filter, func(book *Book) error {
+		if !first && r.failErr != nil {
+			return r.failErr
+		}
+		first = false
+		return fn(book)
+	}, opts...)
+}
+
+func TestExportStreams(t *testing.T) {
+	inner := newTestRepository(t)
+	createBooks(t, inner, "Dune", "Emma", "Go in Action")
+	repo := &streamOnlyRepository{Repository: inner, t: t}
+	s := newTestServer(t, repo)
+
+	resp := s.get(t, "/books/export?format=json&search=zzz", nil)
+	expectStatus(t, resp, fiber.StatusOK)
+	if body := readBody(t, resp); body != "[]" {
+		t.Errorf("empty json export %q, want []", body)
+	}
+	resp = s.get(t, "/books/export?format=json&search=e", nil)
+	var books []*Book
+	decodeJSON(t, resp, &books)
+	if got := bookTitles(books); !slices.Equal(got, []string{"Dune", "Emma"}) {
+		t.Errorf("filtered json export %q", got)
+	}
+
+	logger, logs := observedLogger(zapcore.ErrorLevel)
+	s.h.logger = logger
+	repo.failErr = errors.New("connection lost")
+	for _, format := range exportFormats {
+		resp := s.get(t, "/books/export?format="+format, nil)
+		expectStatus(t, resp, fiber.StatusOK)
+		if body := readBody(t, resp); strings.Contains(body, "Emma") {
+			t.Errorf("%s: export carried on past the failure", format)
+		}
+	}
+	// The error is logged after the body ends, so give the last one a moment
+	deadline := time.Now().Add(time.Second)
+	for logs.Len() < len(exportFormats) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var logged []string
+	for _, entry := range logs.FilterMessage("Failed to stream books for export").All() {
+		fields := entry.ContextMap()
+		if fields["error"] != "connection lost" {
+			t.Errorf("failure logged with %v", fields)
+		}
+		logged = append(logged, fmt.Sprint(fields["format"]))
+	}
+	slices.Sort(logged)
+	if !slices.Equal(logged, exportFormats) {
+		t.Errorf("failures logged for %q, want %q", logged, exportFormats)
+	}
+}
+
+func TestBulkErrors(t *testing.T) {
+	repo := newTestRepository(t)
+	admin := createAccount(t, repo, "Admin", RoleAdmin)
+	s := newTestServer(t, repo, func(c *Config) { c.MaxBulkIDs = 3 })
+
+	for _, tc := range []struct {
+		name    string
+		ids     []string
+		code    string
+		message string
+	}{
+		{"empty", nil, "empty_selection", "Please select at least one book."},
+		{"too many", []string{"1", "2", "3", "4"}, "selection_too_large", "Too many books selected; the limit is 3."},
+		{"invalid", []string{"1", "x"}, "invalid_id", "Invalid book ID."},
+		{"negative", []string{"-2"}, "invalid_id", "Invalid book ID."},
+	} {
+		for _, path := range []string{"/books/delete", "/books/bulk-update-sales", "/books/bulk-set-tags"} {
+			form := url.Values{"book_ids": tc.ids, "action": {"add"}}
+			resp := s.postForm(t, path, form, admin)
+			expectStatus(t, resp, fiber.StatusBadRequest)
+			if body := readBody(t, resp); body != tc.message {
+				t.Errorf("%s %s: %q, want %q", tc.name, path, body, tc.message)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+			req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+			s.signIn(req, admin)
+			resp = s.do(t, req)
+			expectStatus(t, resp, fiber.StatusBadRequest)
+			var body map[string]string
+			decodeJSON(t, resp, &body)
+			if body["code"] != tc.code || body["error"] != tc.message {
+				t.Errorf("%s %s: JSON %v, want code %s", tc.name, path, body, tc.code)
+			}
+		}
+	}
+
+	batch := BookBatch{Delete: []int{1, 2, 3, 4}}
+	resp := s.postJSON(t, "/api/books/batch", batch, admin)
+	expectStatus(t, resp, fiber.StatusBadRequest)
+	var body map[string]string
+	decodeJSON(t, resp, &body)
+	if body["code"] != "selection_too_large" {
+		t.Errorf("oversized batch: %v", body)
+	}
+}
+
+// titleCheckCounter counts the calls checking for existing titles
+type titleCheckCounter struct {
+	Repository
+	titleExists, listTitles int
+}
+
+func (r *titleCheckCounter) TitleExists(ctx context.Context, title string) (bool, error) {
+	r.titleExists++
+	return r.Repository.TitleExists(ctx, title)
+}
+
+func (r *titleCheckCounter) ListTitles(ctx context.Context) ([]string, error) {
+	r.listTitles++
+	return r.Repository.ListTitles(ctx)
+}
+
+func TestImportSkipsExistingTitles(t *testing.T) {
+	repo := &titleCheckCounter{Repository: newTestRepository(t)}
+	s := newTestServer(t, repo)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Moving Dune fails, as if the run was cut short after saving its book
+	if err := os.MkdirAll(filepath.Join(dir, "processed", "Dune.txt", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeImportFiles(t, dir, "Dune", "Emma")
+	stats, err := s.h.importBooksFromDir(ctx, dir, func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Imported != 2 {
+		t.Fatalf("first run stats %+v", stats)
+	}
+
+	os.RemoveAll(filepath.Join(dir, "processed", "Dune.txt"))
+	writeImportFiles(t, dir, "Persuasion", "persuasion ", "EMMA")
+	stats, err = s.h.importBooksFromDir(ctx, dir, func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Imported != 1 || stats.Skipped != 3 {
+		t.Errorf("second run stats %+v, want 1 imported and 3 skipped", stats)
+	}
+
+	result, err := repo.ListBooks(ctx, 10, 0, "", "all", WithSort("title"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookTitles(result.Books); len(got) != 3 || got[0] != "Dune" || got[1] != "Emma" || !strings.EqualFold(got[2], "Persuasion") {
+		t.Errorf("books %q, want Dune, Emma and one Persuasion", got)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*.txt")); len(left) != 0 {
+		t.Errorf("files left behind: %q", left)
+	}
+	if repo.titleExists != 0 || repo.listTitles != 2 {
+		t.Errorf("TitleExists called %d times and ListTitles %d, want 0 and one per run", repo.titleExists, repo.listTitles)
+	}
+}
+
+func TestSampledCoreKeepsErrors(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newSampledCore(core, 2, 0)).With(zap.String("component", "test"))
+
+	for range 100 {
+		logger.Info("request served")
+		logger.Error("request failed")
+	}
+
+	if infos := logs.FilterMessage("request served").Len(); infos != 2 {
+		t.Errorf("%d info logs kept, want the first 2", infos)
+	}
+	if errs := logs.FilterMessage("request failed").Len(); errs != 100 {
+		t.Errorf("%d error logs kept, want all 100", errs)
+	}
+}